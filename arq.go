@@ -0,0 +1,189 @@
+// arq.go - Reliable message sending with automatic retransmission.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+// ErrMaxRetransmissions is the error issued when a reliable message was not
+// acknowledged after the maximum number of retransmissions.
+var ErrMaxRetransmissions = errors.New("failure sending reliable message, maximum retransmissions reached")
+
+// arqMessage is the retransmission state of a reliable message.
+type arqMessage struct {
+	msg       *Message
+	attempts  uint32
+	delivered uint32
+}
+
+// arqTimeout is scheduled on the retransmission TimerQueue when a reliable
+// message is sent, it fires when the reply is overdue.
+type arqTimeout struct {
+	id       [cConstants.MessageIDLength]byte
+	attempt  uint32
+	deadline time.Time
+}
+
+// Priority implements Item, the TimerQueue orders items by deadline.
+func (t *arqTimeout) Priority() uint64 {
+	return uint64(t.deadline.UnixNano())
+}
+
+// arqRetransmitter receives the timeouts forwarded by the TimerQueue.
+type arqRetransmitter struct {
+	s *Session
+}
+
+// Push implements nqueue.  The TimerQueue panics on error, so failures are
+// handled here.
+func (r *arqRetransmitter) Push(i Item) error {
+	r.s.onARQTimeout(i.(*arqTimeout))
+	return nil
+}
+
+// maxARQBackoff is the longest wait for a reply to a retransmission.
+const maxARQBackoff = time.Hour
+
+// arqBackoff returns how long to wait for a reply to the given attempt,
+// doubling the round trip timeout with each retransmission up to
+// maxARQBackoff.
+func arqBackoff(timeout time.Duration, attempt uint32) time.Duration {
+	for i := uint32(1); i < attempt && timeout < maxARQBackoff; i++ {
+		timeout *= 2
+	}
+	if timeout > maxARQBackoff {
+		return maxARQBackoff
+	}
+	return timeout
+}
+
+// SendReliableMessage asynchronously sends message and retransmits it with
+// fresh SURBs until a reply is received or the maximum number of
+// retransmissions is reached.
+func (s *Session) SendReliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	return s.SendReliableMessageWithPriority(recipient, provider, message, 0)
+}
+
+// SendReliableMessageWithPriority is like SendReliableMessage but sets the
+// queue priority of the message and of its retransmissions.
+func (s *Session) SendReliableMessageWithPriority(recipient, provider string, message []byte, priority uint64) (*[cConstants.MessageIDLength]byte, error) {
+	msg, err := s.composeMessage(recipient, provider, message, false)
+	if err != nil {
+		return nil, err
+	}
+	msg.Reliable = true
+	msg.QueuePriority = priority
+	s.arqMap.Store(*msg.ID, &arqMessage{msg: msg})
+	err = s.enqueue(msg)
+	if err != nil {
+		s.arqMap.Delete(*msg.ID)
+		return nil, err
+	}
+	return msg.ID, nil
+}
+
+// onARQSent is called once a reliable message has been handed to the
+// Provider, or has failed to be, and schedules its retransmission.
+func (s *Session) onARQSent(msg *Message, err error) {
+	raw, ok := s.arqMap.Load(*msg.ID)
+	if !ok {
+		return
+	}
+	state := raw.(*arqMessage)
+	attempt := atomic.AddUint32(&state.attempts, 1)
+	s.eventCh.In() <- &MessageAttemptEvent{
+		MessageID: msg.ID,
+		Attempt:   int(attempt),
+		SentAt:    msg.SentAt,
+		ReplyETA:  msg.ReplyETA,
+		Err:       err,
+	}
+	s.arqTimerQueue.Push(&arqTimeout{
+		id:       *msg.ID,
+		attempt:  attempt,
+		deadline: s.clock.Now().Add(arqBackoff(s.replyTimeout(msg), attempt)),
+	})
+}
+
+// onARQReply is called upon receiving a reply to a reliable message and
+// returns false if the message was already delivered.
+func (s *Session) onARQReply(msg *Message) bool {
+	raw, ok := s.arqMap.Load(*msg.ID)
+	if !ok {
+		return false
+	}
+	state := raw.(*arqMessage)
+	if !atomic.CompareAndSwapUint32(&state.delivered, 0, 1) {
+		return false
+	}
+	s.arqMap.Delete(*msg.ID)
+	s.eventCh.In() <- &MessageDeliveredEvent{
+		MessageID: msg.ID,
+		Attempts:  int(atomic.LoadUint32(&state.attempts)),
+	}
+	return true
+}
+
+func (s *Session) onARQTimeout(t *arqTimeout) {
+	raw, ok := s.arqMap.Load(t.id)
+	if !ok {
+		return
+	}
+	state := raw.(*arqMessage)
+	if atomic.LoadUint32(&state.delivered) == 1 || atomic.LoadUint32(&state.attempts) != t.attempt {
+		return
+	}
+	if s.isPaused() {
+		// The reply may be waiting at the Provider until Resume.
+		t.deadline = s.clock.Now().Add(cConstants.RoundTripTimeSlop)
+		s.arqTimerQueue.Push(t)
+		return
+	}
+	if t.attempt > uint32(s.maxRetransmissions()) {
+		s.arqMap.Delete(t.id)
+		s.statuses.setState(state.msg.ID, MessageFailed, ErrMaxRetransmissions)
+		s.eventCh.In() <- &MessageFailedEvent{
+			MessageID: state.msg.ID,
+			Attempts:  int(t.attempt),
+			Err:       ErrMaxRetransmissions,
+		}
+		return
+	}
+	s.log.Debugf("Retransmitting reliable message %x, attempt %d", t.id, t.attempt+1)
+	if err := s.egressQueue.Push(state.msg); err == nil {
+		s.statuses.queued(state.msg.ID)
+	} else {
+		// Try again once the egress queue had a chance to drain.
+		s.log.Warningf("Failed to requeue reliable message %x: %v", t.id, err)
+		t.deadline = s.clock.Now().Add(cConstants.RoundTripTimeSlop)
+		s.arqTimerQueue.Push(t)
+	}
+}
+
+// maxRetransmissions returns the configured maximum number of
+// retransmissions, none unless the configuration was fixed up.
+func (s *Session) maxRetransmissions() int {
+	if n := s.cfg.Debug.MaxRetransmissions; n != nil && *n > 0 {
+		return *n
+	}
+	return 0
+}
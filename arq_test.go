@@ -0,0 +1,61 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestARQBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	base := 2*time.Second + cConstants.RoundTripTimeSlop
+	assert.Equal(base, arqBackoff(base, 1))
+	assert.Equal(2*base, arqBackoff(base, 2))
+	assert.Equal(8*base, arqBackoff(base, 4))
+
+	// the backoff is bounded and does not overflow
+	assert.Equal(maxARQBackoff, arqBackoff(base, 20))
+	assert.Equal(maxARQBackoff, arqBackoff(base, 1000))
+	assert.Equal(maxARQBackoff, arqBackoff(2*maxARQBackoff, 1))
+}
+
+func TestARQTimeoutOrdering(t *testing.T) {
+	assert := assert.New(t)
+
+	// timeouts are forwarded in deadline order
+	clk := clock.NewFake(time.Unix(1000, 0))
+	q := make(chanQueue, 2)
+	a := NewTimerQueueWithClock(q, clk)
+	defer a.Halt()
+	now := clk.Now()
+	late := &arqTimeout{attempt: 2, deadline: now.Add(200 * time.Millisecond)}
+	early := &arqTimeout{attempt: 1, deadline: now.Add(100 * time.Millisecond)}
+	a.Push(late)
+	a.Push(early)
+	// The worker misses the wakeup if it is not waiting yet.
+	for clk.Timers() == 0 {
+		a.Signal()
+		<-time.After(time.Millisecond)
+	}
+	clk.Advance(200 * time.Millisecond)
+
+	assert.Equal(early, <-q)
+	assert.Equal(late, <-q)
+}
+
+func TestMaxRetransmissions(t *testing.T) {
+	assert := assert.New(t)
+
+	none, three := 0, 3
+	s := &Session{cfg: &config.Config{Debug: &config.Debug{MaxRetransmissions: &none}}}
+	assert.Equal(0, s.maxRetransmissions())
+	s.cfg.Debug.MaxRetransmissions = &three
+	assert.Equal(3, s.maxRetransmissions())
+	s.cfg.Debug.MaxRetransmissions = nil
+	assert.Equal(0, s.maxRetransmissions())
+}
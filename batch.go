@@ -0,0 +1,216 @@
+// batch.go - Atomic batch sending.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+// ErrEmptyBatch is the error issued when sending a batch without messages.
+var ErrEmptyBatch = errors.New("batch has no messages")
+
+// BatchMessage is a message of a batch.
+type BatchMessage struct {
+	// Recipient is the destination identity of the message.
+	Recipient string
+
+	// Provider is the destination Provider of the message.
+	Provider string
+
+	// Payload is the message payload.
+	Payload []byte
+}
+
+// BatchResult is the outcome of a message of a batch.
+type BatchResult struct {
+	// MessageID is the local unique identifier for the message.
+	MessageID *[cConstants.MessageIDLength]byte
+
+	// State is MessageReplied, MessageFailed, MessageGarbageCollected or
+	// MessageCancelled once the message completed, otherwise
+	// MessageQueued.
+	State MessageState
+
+	// Reply is the reply payload, if any.
+	Reply []byte
+
+	// Err is the error which made the message fail, or the error returned
+	// by the reply check of the message.
+	Err error
+}
+
+// Batch tracks the completion of the messages of a batch.  A message
+// completes once its reply is received, it fails to be sent, its SURB is
+// garbage collected or it is cancelled.
+type Batch struct {
+	sync.Mutex
+
+	results []BatchResult
+	index   map[[cConstants.MessageIDLength]byte]int
+	pending int
+	done    chan struct{}
+}
+
+func newBatch(msgs []*Message) *Batch {
+	b := &Batch{
+		results: make([]BatchResult, len(msgs)),
+		index:   make(map[[cConstants.MessageIDLength]byte]int),
+		pending: len(msgs),
+		done:    make(chan struct{}),
+	}
+	for i, msg := range msgs {
+		b.results[i] = BatchResult{
+			MessageID: msg.ID,
+			State:     MessageQueued,
+		}
+		b.index[*msg.ID] = i
+	}
+	return b
+}
+
+func (b *Batch) complete(id *[cConstants.MessageIDLength]byte, state MessageState, reply []byte, err error) {
+	b.Lock()
+	defer b.Unlock()
+	i, ok := b.index[*id]
+	if !ok || b.results[i].State != MessageQueued {
+		return
+	}
+	b.results[i].State = state
+	b.results[i].Reply = reply
+	b.results[i].Err = err
+	b.pending--
+	if b.pending == 0 {
+		close(b.done)
+	}
+}
+
+// MessageIDs returns the identifiers of the messages, in the order they
+// were given.
+func (b *Batch) MessageIDs() []*[cConstants.MessageIDLength]byte {
+	ids := make([]*[cConstants.MessageIDLength]byte, 0, len(b.results))
+	for _, result := range b.results {
+		ids = append(ids, result.MessageID)
+	}
+	return ids
+}
+
+// Done returns a channel which is closed once every message completed.
+func (b *Batch) Done() <-chan struct{} {
+	return b.done
+}
+
+// Results returns the current outcome of the messages, in the order they
+// were given.
+func (b *Batch) Results() []BatchResult {
+	b.Lock()
+	defer b.Unlock()
+	return append([]BatchResult{}, b.results...)
+}
+
+// Wait blocks until every message completed or the context is done, and
+// returns the outcome of the messages along with the context error if any.
+func (b *Batch) Wait(ctx context.Context) ([]BatchResult, error) {
+	select {
+	case <-b.done:
+		return b.Results(), nil
+	case <-ctx.Done():
+		return b.Results(), ctx.Err()
+	}
+}
+
+// SendBatch asynchronously sends the messages without any automatic
+// retransmissions.  Either every message is queued or none is, in which
+// case an error is returned.
+func (s *Session) SendBatch(batch []BatchMessage) (*Batch, error) {
+	if len(batch) == 0 {
+		return nil, ErrEmptyBatch
+	}
+	msgs := make([]*Message, 0, len(batch))
+	items := make([]Item, 0, len(batch))
+	for _, m := range batch {
+		msg, err := s.composeMessage(m.Recipient, m.Provider, m.Payload, false)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		items = append(items, msg)
+	}
+
+	// Register the batch first as a reply may be received before
+	// PushBatch returns.
+	b := newBatch(msgs)
+	for _, msg := range msgs {
+		s.statuses.queued(msg.ID)
+		s.batches.Store(*msg.ID, b)
+	}
+	if err := s.pushItems(items); err != nil {
+		for _, msg := range msgs {
+			s.statuses.remove(msg.ID)
+			s.batches.Delete(*msg.ID)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// pushItems pushes all of the items onto the egress queue, or none of them.
+// Unless the queue is a BatchQueue, the items are pushed one at a time while
+// the worker is kept from sending, and removed again upon failure, which
+// requires a RemovableQueue.
+func (s *Session) pushItems(items []Item) error {
+	if queue, ok := s.egressQueue.(BatchQueue); ok {
+		return queue.PushBatch(items)
+	}
+	if len(items) == 1 {
+		return s.egressQueue.Push(items[0])
+	}
+	queue, ok := s.egressQueue.(RemovableQueue)
+	if !ok {
+		return ErrQueueNotAtomic
+	}
+
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	for i, item := range items {
+		err := queue.Push(item)
+		if err == nil {
+			continue
+		}
+		for _, pushed := range items[:i] {
+			if _, rmErr := queue.Remove(func(queued Item) bool { return queued == pushed }); rmErr != nil {
+				s.log.Errorf("Failed to remove a message of a partially queued batch: %v", rmErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// completeBatchMessage records the outcome of a message if it belongs to a
+// batch.
+func (s *Session) completeBatchMessage(id *[cConstants.MessageIDLength]byte, state MessageState, reply []byte, err error) {
+	raw, ok := s.batches.Load(*id)
+	if !ok {
+		return
+	}
+	s.batches.Delete(*id)
+	raw.(*Batch).complete(id, state, reply, err)
+}
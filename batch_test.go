@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatch(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	msgs := []*Message{newTestMessage(1), newTestMessage(2), newTestMessage(3)}
+	b := newBatch(msgs)
+	ids := b.MessageIDs()
+	require.Len(ids, 3)
+	assert.Equal(byte(2), ids[1][0])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	results, err := b.Wait(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Equal(MessageQueued, results[0].State)
+
+	sendErr := errors.New("send failure")
+	b.complete(msgs[2].ID, MessageFailed, nil, sendErr)
+	b.complete(msgs[0].ID, MessageReplied, []byte("reply"), nil)
+	// only the first outcome of a message counts
+	b.complete(msgs[0].ID, MessageGarbageCollected, nil, nil)
+	select {
+	case <-b.Done():
+		t.Fatal("batch completed early")
+	default:
+	}
+	b.complete(msgs[1].ID, MessageCancelled, nil, nil)
+
+	results, err = b.Wait(context.Background())
+	require.NoError(err)
+	assert.Equal(MessageReplied, results[0].State)
+	assert.Equal([]byte("reply"), results[0].Reply)
+	assert.Equal(MessageCancelled, results[1].State)
+	assert.Equal(MessageFailed, results[2].State)
+	assert.Equal(sendErr, results[2].Err)
+}
+
+func TestPushItemsFallback(t *testing.T) {
+	assert := assert.New(t)
+
+	var _ BatchQueue = new(Queue)
+	var _ BatchQueue = new(PriorityQueue)
+	var _ BatchQueue = new(PersistentQueue)
+
+	// a third party queue without PushBatch
+	q := new(Queue)
+	s := &Session{
+		egressQueue: struct{ RemovableQueue }{q},
+	}
+	for i := 0; i < constants.MaxEgressQueueSize-2; i++ {
+		assert.NoError(q.Push(newTestMessage(0)))
+	}
+	batch := []Item{newTestMessage(1), newTestMessage(2), newTestMessage(3)}
+	assert.Equal(ErrQueueFull, s.pushItems(batch))
+	// the first two messages were removed again
+	for i := 0; i < constants.MaxEgressQueueSize-2; i++ {
+		m, err := q.Pop()
+		assert.NoError(err)
+		assert.Equal(byte(0), m.(*Message).ID[0])
+	}
+	_, err := q.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+
+	assert.NoError(s.pushItems(batch))
+	for _, id := range []byte{1, 2, 3} {
+		m, err := q.Pop()
+		assert.NoError(err)
+		assert.Equal(id, m.(*Message).ID[0])
+	}
+
+	s.egressQueue = struct{ EgressQueue }{q}
+	assert.Equal(ErrQueueNotAtomic, s.pushItems(batch))
+	assert.NoError(s.pushItems(batch[:1]))
+}
@@ -0,0 +1,249 @@
+// budget.go - Bandwidth budget enforcement.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/pki"
+)
+
+// decoyBudgetReserve is the fraction of the budget which only real sends
+// may use, so that decoys are suppressed before real sends are held.
+const decoyBudgetReserve = 0.1
+
+// tokenBucket is a token bucket refilled continuously at rate tokens per
+// second up to its capacity.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity float64, period time.Duration, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: capacity,
+		tokens:   capacity,
+		rate:     capacity / period.Seconds(),
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// available returns true if n tokens can be taken while leaving reserve
+// of the capacity in the bucket.
+func (b *tokenBucket) available(n, reserve float64) bool {
+	return b.tokens-n >= b.capacity*reserve
+}
+
+// bandwidthBudget limits the Sphinx packets sent per hour and the bytes
+// sent per day.
+type bandwidthBudget struct {
+	sync.Mutex
+
+	packets *tokenBucket
+	bytes   *tokenBucket
+
+	decoyScale      float64
+	sendScale       float64
+	decoysThrottled bool
+	sendsThrottled  bool
+}
+
+func newBandwidthBudget(cfg *config.Bandwidth, now time.Time) *bandwidthBudget {
+	b := &bandwidthBudget{
+		decoyScale: 1,
+		sendScale:  1,
+	}
+	if cfg.PacketsPerHour > 0 {
+		b.packets = newTokenBucket(float64(cfg.PacketsPerHour), time.Hour, now)
+	}
+	if cfg.BytesPerDay > 0 {
+		b.bytes = newTokenBucket(float64(cfg.BytesPerDay), 24*time.Hour, now)
+	}
+	return b
+}
+
+// rate returns the sustainable rate of the budget in packets per
+// millisecond, the unit of the PKI document lambdas.
+func (b *bandwidthBudget) rate() float64 {
+	rate := math.Inf(1)
+	if b.packets != nil {
+		rate = math.Min(rate, b.packets.rate/1000)
+	}
+	if b.bytes != nil {
+		rate = math.Min(rate, b.bytes.rate/constants.PacketLength/1000)
+	}
+	return rate
+}
+
+// setDocument scales down the decoy rates of the document first, then the
+// LambdaP rate, to fit the sustainable rate of the budget, and returns true
+// if the scales changed.
+func (b *bandwidthBudget) setDocument(doc *pki.Document) bool {
+	b.Lock()
+	defer b.Unlock()
+	rate := b.rate()
+	decoyScale, sendScale := 1.0, 1.0
+	decoyRate := doc.LambdaL + doc.LambdaD
+	switch {
+	case rate >= doc.LambdaP+decoyRate:
+	case rate > doc.LambdaP:
+		decoyScale = (rate - doc.LambdaP) / decoyRate
+	default:
+		decoyScale = 0
+		if doc.LambdaP > 0 {
+			sendScale = rate / doc.LambdaP
+		}
+	}
+	changed := decoyScale != b.decoyScale || sendScale != b.sendScale
+	b.decoyScale, b.sendScale = decoyScale, sendScale
+	return changed
+}
+
+// scale returns the factor the rate of the traffic kind is scaled by.
+func (b *bandwidthBudget) scale(kind TrafficKind) float64 {
+	b.Lock()
+	defer b.Unlock()
+	if kind == TrafficSend {
+		return b.sendScale
+	}
+	return b.decoyScale
+}
+
+// available returns true if a packet can be sent while leaving reserve of
+// the budget.
+func (b *bandwidthBudget) available(reserve float64) bool {
+	return (b.packets == nil || b.packets.available(1, reserve)) &&
+		(b.bytes == nil || b.bytes.available(constants.PacketLength, reserve))
+}
+
+// spend takes a packet from the budget if available and returns true on
+// success, along with whether the throttling state changed.
+func (b *bandwidthBudget) spend(now time.Time, decoy bool) (bool, bool) {
+	b.Lock()
+	defer b.Unlock()
+	for _, bucket := range []*tokenBucket{b.packets, b.bytes} {
+		if bucket != nil {
+			bucket.refill(now)
+		}
+	}
+	reserve := 0.0
+	if decoy {
+		reserve = decoyBudgetReserve
+	}
+	ok := b.available(reserve)
+	if ok {
+		if b.packets != nil {
+			b.packets.tokens--
+		}
+		if b.bytes != nil {
+			b.bytes.tokens -= constants.PacketLength
+		}
+	}
+	decoysThrottled := !b.available(decoyBudgetReserve)
+	sendsThrottled := !b.available(0)
+	changed := decoysThrottled != b.decoysThrottled || sendsThrottled != b.sendsThrottled
+	b.decoysThrottled, b.sendsThrottled = decoysThrottled, sendsThrottled
+	return ok, changed
+}
+
+func (b *bandwidthBudget) event() *BandwidthBudgetEvent {
+	b.Lock()
+	defer b.Unlock()
+	e := &BandwidthBudgetEvent{
+		RemainingPackets: -1,
+		RemainingBytes:   -1,
+		DecoyRateScale:   b.decoyScale,
+		SendRateScale:    b.sendScale,
+		DecoysThrottled:  b.decoysThrottled,
+		SendsThrottled:   b.sendsThrottled,
+	}
+	if b.packets != nil {
+		e.RemainingPackets = int64(b.packets.tokens)
+	}
+	if b.bytes != nil {
+		e.RemainingBytes = int64(b.bytes.tokens)
+	}
+	return e
+}
+
+// budgetScheduler stretches the delays of a TrafficScheduler to fit the
+// sustainable rate of a bandwidth budget.
+type budgetScheduler struct {
+	TrafficScheduler
+
+	budget *bandwidthBudget
+	notify func()
+}
+
+// SetDocument implements TrafficScheduler.
+func (b *budgetScheduler) SetDocument(doc *pki.Document) {
+	b.TrafficScheduler.SetDocument(doc)
+	if b.budget.setDocument(doc) {
+		b.notify()
+	}
+}
+
+// Next implements TrafficScheduler.
+func (b *budgetScheduler) Next(kind TrafficKind) time.Duration {
+	const maxDuration = math.MaxInt64
+	d := b.TrafficScheduler.Next(kind)
+	scale := b.budget.scale(kind)
+	if scale >= 1 {
+		return d
+	}
+	stretched := float64(d) / scale
+	if scale <= 0 || stretched >= maxDuration {
+		return time.Duration(maxDuration)
+	}
+	return time.Duration(stretched)
+}
+
+// spendBandwidth takes a packet from the bandwidth budget if any, and
+// returns false if the packet must not be sent.
+func (s *Session) spendBandwidth(decoy bool) bool {
+	if s.budget == nil {
+		return true
+	}
+	ok, changed := s.budget.spend(s.clock.Now(), decoy)
+	if changed {
+		s.emitBandwidthBudget()
+	}
+	return ok
+}
+
+func (s *Session) emitBandwidthBudget() {
+	e := s.budget.event()
+	if e.SendsThrottled {
+		s.log.Warningf("Bandwidth budget exhausted, holding queued messages")
+	} else if e.DecoysThrottled {
+		s.log.Noticef("Bandwidth budget low, suppressing decoy traffic")
+	}
+	s.eventCh.In() <- e
+}
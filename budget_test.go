@@ -0,0 +1,75 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/core/constants"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBandwidthBudgetSpend(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	b := newBandwidthBudget(&config.Bandwidth{PacketsPerHour: 10}, now)
+
+	// decoys leave a reserve to real sends
+	for i := 0; i < 9; i++ {
+		ok, _ := b.spend(now, true)
+		assert.True(ok)
+	}
+	ok, changed := b.spend(now, true)
+	assert.False(ok)
+	assert.False(changed)
+	assert.True(b.event().DecoysThrottled)
+	ok, changed = b.spend(now, false)
+	assert.True(ok)
+	assert.True(changed)
+	e := b.event()
+	assert.True(e.SendsThrottled)
+	assert.Equal(int64(0), e.RemainingPackets)
+	assert.Equal(int64(-1), e.RemainingBytes)
+	ok, _ = b.spend(now, false)
+	assert.False(ok)
+
+	// the budget is refilled over time
+	ok, changed = b.spend(now.Add(12*time.Minute), false)
+	assert.True(ok)
+	assert.True(changed)
+	assert.False(b.event().SendsThrottled)
+}
+
+func TestBandwidthBudgetScales(t *testing.T) {
+	assert := assert.New(t)
+
+	// 0.001 packets per millisecond
+	packetsPerHour := 3600
+	b := newBandwidthBudget(&config.Bandwidth{PacketsPerHour: packetsPerHour}, time.Now())
+	doc := newTestTrafficDocument()
+	doc.LambdaP, doc.LambdaL, doc.LambdaD = 0.0005, 0.001, 0.001
+	assert.True(b.setDocument(doc))
+	assert.InDelta(0.25, b.scale(TrafficLoopDecoy), 1e-9)
+	assert.Equal(1.0, b.scale(TrafficSend))
+	assert.False(b.setDocument(doc))
+
+	doc.LambdaP = 0.004
+	assert.True(b.setDocument(doc))
+	assert.Equal(0.0, b.scale(TrafficDropDecoy))
+	assert.InDelta(0.25, b.scale(TrafficSend), 1e-9)
+
+	// the byte limit applies too
+	b = newBandwidthBudget(&config.Bandwidth{BytesPerDay: 24 * 3600 * constants.PacketLength}, time.Now())
+	doc.LambdaP, doc.LambdaL, doc.LambdaD = 0.002, 0, 0
+	b.setDocument(doc)
+	assert.InDelta(0.5, b.scale(TrafficSend), 1e-9)
+
+	s := &budgetScheduler{
+		TrafficScheduler: NewConstantScheduler(),
+		budget:           b,
+		notify:           func() {},
+	}
+	s.SetDocument(doc)
+	assert.Equal(time.Second, s.Next(TrafficSend))
+}
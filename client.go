@@ -7,125 +7,43 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	mrand "math/rand"
-	"net/url"
-	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/hashcloak/Meson-client/config"
-	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
+	kpki "github.com/hashcloak/Meson-client/pkiclient"
 	"github.com/katzenpost/core/crypto/ecdh"
-	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
-	"github.com/katzenpost/core/pki"
-	registration "github.com/katzenpost/registration_client"
 	"gopkg.in/op/go-logging.v1"
 )
 
-const (
-	initialPKIConsensusTimeout = 10 * time.Second
-)
-
-func AutoRegisterRandomClient(cfg *config.Config) *ecdh.PrivateKey {
-	// Retrieve a copy of the PKI consensus document.
-	logFile, err := ioutil.TempFile("", "meson-client-registration-log")
-	if err != nil {
-		panic(err)
-	}
-	defer os.Remove(logFile.Name())
-	backendLog, err := log.New(logFile.Name(), "ERROR", false)
-	if err != nil {
-		panic(err)
-	}
-	proxyCfg := cfg.UpstreamProxyConfig()
-	pkiClient, err := cfg.NewPKIClient(backendLog, proxyCfg)
-	if err != nil {
-		panic(err)
-	}
-	// have to shutdown pkiclient and release database
-	// maybe find better solution?
-	defer pkiClient.Shutdown()
-	currentEpoch, _, _, err := epochtime.Now(pkiClient)
-	if err != nil {
-		panic(err)
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), initialPKIConsensusTimeout)
-	defer cancel()
-	doc, _, err := pkiClient.GetDoc(ctx, currentEpoch)
-	if err != nil {
-		panic(err)
-	}
-
-	// Pick a registration Provider.
-	registerProviders := []*pki.MixDescriptor{}
-	for _, provider := range doc.Providers {
-		if provider.RegistrationHTTPAddresses != nil {
-			registerProviders = append(registerProviders, provider)
-		}
-	}
-	if len(registerProviders) == 0 {
-		panic("zero registration Providers found in the consensus")
-	}
-	mrand.Seed(time.Now().UTC().UnixNano())
-	registrationProvider := registerProviders[mrand.Intn(len(registerProviders))]
-
-	// Register with that Provider.
-	// "registering client with mixnet Provider"
-	linkKey, err := ecdh.NewKeypair(rand.Reader)
-	if err != nil {
-		panic(err)
-	}
-	account := &config.Account{
-		User:           fmt.Sprintf("%x", linkKey.PublicKey().Bytes()),
-		Provider:       registrationProvider.Name,
-		ProviderKeyPin: registrationProvider.IdentityKey,
-	}
-
-	u, err := url.Parse(registrationProvider.RegistrationHTTPAddresses[0])
-	if err != nil {
-		panic(err)
-	}
-	cfgRegistration := &config.Registration{
-		Address: u.Host,
-		Options: &registration.Options{
-			Scheme:       u.Scheme,
-			UseSocks:     strings.HasPrefix(cfg.UpstreamProxy.Type, "socks"),
-			SocksNetwork: cfg.UpstreamProxy.Network,
-			SocksAddress: cfg.UpstreamProxy.Address,
-		},
-	}
-	cfg.Account = account
-	cfg.Registration = cfgRegistration
-	err = RegisterClient(cfg, linkKey.PublicKey())
-	if err != nil {
-		panic(err)
-	}
-	return linkKey
-}
-
-func RegisterClient(cfg *config.Config, linkKey *ecdh.PublicKey) error {
-	client, err := registration.New(cfg.Registration.Address, cfg.Registration.Options)
-	if err != nil {
-		return err
-	}
-	err = client.RegisterAccountWithLinkKey(cfg.Account.User, linkKey)
-	return err
-}
-
 type Client struct {
 	cfg        *config.Config
 	logBackend *log.Backend
 	log        *logging.Logger
-	fatalErrCh chan error
 	haltedCh   chan interface{}
 	haltOnce   *sync.Once
-	session    *Session
 	linkKey    *ecdh.PrivateKey
 	service    string
+
+	// sessions holds the session of every account, keyed by
+	// account identifier, all sharing the same PKI client.  session
+	// is the session created by NewSession.
+	sessionsLock sync.Mutex
+	session      *Session
+	sessions     map[string]*Session
+	pkiClient    kpki.Client
+	pkiCache     *kpki.Cache
+
+	// newSession establishes the sessions of the accounts.
+	newSession func(ctx context.Context, fatalErrCh chan error, logBackend *log.Backend, cfg *config.Config, linkKey *ecdh.PrivateKey, pkiClient kpki.Client, opts ...SessionOption) (*Session, error)
+}
+
+// AccountID returns the identifier of the account, as used to look up
+// the account's Session.
+func AccountID(account *config.Account) string {
+	return fmt.Sprintf("%s@%s", account.User, account.Provider)
 }
 
 // Start begins a Meson client.
@@ -135,8 +53,11 @@ type Client struct {
 func (c *Client) Start() error {
 	var err error
 	// Retrieve PKI consensus documents and related info
-	c.linkKey = AutoRegisterRandomClient(c.cfg)
-	c.session, err = c.NewSession(c.linkKey)
+	c.linkKey, err = LoadOrRegisterClient(c.cfg)
+	if err != nil {
+		return err
+	}
+	_, err = c.NewSession(c.linkKey)
 	return err
 }
 
@@ -179,10 +100,18 @@ func (c *Client) Wait() {
 
 func (c *Client) halt() {
 	c.log.Noticef("Starting graceful shutdown.")
-	if c.session != nil {
-		c.session.Shutdown()
+	c.sessionsLock.Lock()
+	for id, session := range c.sessions {
+		session.Shutdown()
+		delete(c.sessions, id)
+	}
+	if c.pkiCache != nil {
+		c.pkiCache.Shutdown()
+		c.pkiClient.Shutdown()
+		c.pkiCache = nil
+		c.pkiClient = nil
 	}
-	close(c.fatalErrCh)
+	c.sessionsLock.Unlock()
 	close(c.haltedCh)
 }
 
@@ -192,27 +121,18 @@ func (c *Client) halt() {
 func New(cfg *config.Config, service string) (*Client, error) {
 	client := &Client{
 		cfg:        cfg,
-		fatalErrCh: make(chan error),
 		haltedCh:   make(chan interface{}),
 		haltOnce:   new(sync.Once),
 		linkKey:    new(ecdh.PrivateKey),
 		service:    service,
+		sessions:   make(map[string]*Session),
+		newSession: newSession,
 	}
 
 	if err := client.InitLogging(); err != nil {
 		return nil, err
 	}
 
-	// Start the fatal error watcher.
-	go func() {
-		err, ok := <-client.fatalErrCh
-		if !ok {
-			return
-		}
-		client.log.Warningf("Shutting down due to error: %v", err)
-		client.Shutdown()
-	}()
-
 	return client, nil
 }
 
@@ -220,39 +140,192 @@ func New(cfg *config.Config, service string) (*Client, error) {
 func NewFromConfig(cfg *config.Config, service string) (*Client, error) {
 	client := &Client{
 		cfg:        cfg,
-		fatalErrCh: make(chan error),
 		haltedCh:   make(chan interface{}),
 		haltOnce:   new(sync.Once),
 		linkKey:    new(ecdh.PrivateKey),
 		service:    service,
+		sessions:   make(map[string]*Session),
+		newSession: newSession,
 	}
 
 	if err := client.InitLogging(); err != nil {
 		return nil, err
 	}
 
-	// Start the fatal error watcher.
-	go func() {
-		err, ok := <-client.fatalErrCh
-		if !ok {
-			return
-		}
-		client.log.Warningf("Shutting down due to error: %v", err)
-		client.Shutdown()
-	}()
-
 	return client, nil
 }
 
+// sharedPKIClient returns the PKI client shared by all the sessions of
+// the Client, creating it on first use.  It must be called with
+// sessionsLock held.
+func (c *Client) sharedPKIClient() (kpki.Client, error) {
+	if c.pkiCache != nil {
+		return c.pkiCache, nil
+	}
+	pkiClient, err := c.cfg.NewPKIClient(c.logBackend, c.cfg.UpstreamProxyConfig())
+	if err != nil {
+		return nil, err
+	}
+	c.pkiClient = pkiClient
+	c.pkiCache = kpki.NewCacheClient(pkiClient)
+	return c.pkiCache, nil
+}
+
 // New establishes a session with provider using key.
 // This method will block until session is connected to the Provider.
 func (c *Client) NewSession(linkKey *ecdh.PrivateKey) (*Session, error) {
-	var err error
+	session, err := c.NewAccountSession(&Identity{
+		LinkKey: linkKey,
+		Account: c.cfg.Account,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.sessionsLock.Lock()
+	c.session = session
+	c.sessionsLock.Unlock()
+	return session, nil
+}
+
+// defaultSession returns the session created by NewSession, if any.
+func (c *Client) defaultSession() *Session {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	return c.session
+}
+
+// NewAccountSession establishes a session for the given account, in
+// addition to the sessions of the other accounts of the Client.  Each
+// account has its own Session and event stream, while all of them share
+// a single PKI client.  A fatal error of the session only shuts down that
+// session, unless it is the session created by NewSession or the last
+// session of the Client, upon which the Client is shut down.  This method
+// will block until session is connected to the Provider.
+func (c *Client) NewAccountSession(id *Identity) (*Session, error) {
+	accountID := AccountID(id.Account)
+	c.sessionsLock.Lock()
+	if _, ok := c.sessions[accountID]; ok {
+		c.sessionsLock.Unlock()
+		return nil, fmt.Errorf("session for account %v already exists", accountID)
+	}
+	pkiClient, err := c.sharedPKIClient()
+	c.sessionsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Each account gets its own copy of the configuration.
+	cfg := *c.cfg
+	cfg.Account = id.Account
+
 	timeout := time.Duration(c.cfg.Debug.SessionDialTimeout) * time.Second
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	c.session, err = NewSession(ctx, c.fatalErrCh, c.logBackend, c.cfg, linkKey)
-	return c.session, err
+	fatalErrCh := make(chan error)
+	session, err := c.newSession(ctx, fatalErrCh, c.logBackend, &cfg, id.LinkKey, pkiClient)
+	if err != nil {
+		return nil, err
+	}
+
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	if _, ok := c.sessions[accountID]; ok {
+		session.Shutdown()
+		return nil, fmt.Errorf("session for account %v already exists", accountID)
+	}
+	c.sessions[accountID] = session
+	go c.watchSession(accountID, session, fatalErrCh)
+	return session, nil
+}
+
+// watchSession shuts down the session of the account upon its first fatal
+// error, along with the Client if the Client is left without its default
+// session or without any session.
+func (c *Client) watchSession(accountID string, session *Session, fatalErrCh chan error) {
+	select {
+	case err := <-fatalErrCh:
+		c.log.Warningf("Shutting down the session of account %v due to error: %v", accountID, err)
+		if c.closeSession(accountID, session) {
+			c.log.Warningf("Shutting down the client, the session of account %v was its last or default one", accountID)
+			c.Shutdown()
+		}
+	case <-session.HaltCh():
+	}
+}
+
+// RegisterAccount registers a new account as Register does, using the
+// PKI client shared by the sessions of the Client.  The returned Identity
+// may be passed to NewAccountSession.
+func (c *Client) RegisterAccount(ctx context.Context, opts *RegisterOptions) (*Identity, error) {
+	c.sessionsLock.Lock()
+	pkiClient, err := c.sharedPKIClient()
+	c.sessionsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	o := RegisterOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.PKIClient = pkiClient
+	cfg := *c.cfg
+	linkKey, err := Register(ctx, &cfg, &o)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		LinkKey: linkKey,
+		Account: cfg.Account,
+	}, nil
+}
+
+// GetSession returns the Session of the account with the given
+// identifier, see AccountID.
+func (c *Client) GetSession(accountID string) (*Session, bool) {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	session, ok := c.sessions[accountID]
+	return session, ok
+}
+
+// Sessions returns the Sessions of all the accounts of the Client.
+func (c *Client) Sessions() []*Session {
+	c.sessionsLock.Lock()
+	defer c.sessionsLock.Unlock()
+	sessions := make([]*Session, 0, len(c.sessions))
+	for _, session := range c.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// CloseAccountSession shuts down the Session of the account with the
+// given identifier and removes it from the Client.
+func (c *Client) CloseAccountSession(accountID string) error {
+	session, ok := c.GetSession(accountID)
+	if !ok {
+		return fmt.Errorf("no session for account %v", accountID)
+	}
+	c.closeSession(accountID, session)
+	return nil
+}
+
+// closeSession shuts down the session and removes it from the Client,
+// unless the account has another session by now.  It returns true if the
+// session was the default one or the Client has no session left.
+func (c *Client) closeSession(accountID string, session *Session) bool {
+	c.sessionsLock.Lock()
+	if c.sessions[accountID] == session {
+		delete(c.sessions, accountID)
+	}
+	isDefault := c.session == session
+	if isDefault {
+		c.session = nil
+	}
+	isLast := len(c.sessions) == 0
+	c.sessionsLock.Unlock()
+	session.Shutdown()
+	return isDefault || isLast
 }
 
 func ValidateReply(reply []byte) ([]byte, error) {
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	kpki "github.com/hashcloak/Meson-client/pkiclient"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errTestNoDocument = errors.New("no document")
+
+// testPKIClient is a PKI client without any document.
+type testPKIClient struct{}
+
+func (testPKIClient) GetEpoch(context.Context) (uint64, uint64, error) {
+	return 0, 0, errTestNoDocument
+}
+
+func (testPKIClient) GetDoc(context.Context, uint64) (*pki.Document, []byte, error) {
+	return nil, nil, errTestNoDocument
+}
+
+func (testPKIClient) Post(context.Context, uint64, *eddsa.PrivateKey, *pki.MixDescriptor) error {
+	return nil
+}
+
+func (testPKIClient) Deserialize([]byte) (*pki.Document, error) {
+	return nil, errTestNoDocument
+}
+
+func (testPKIClient) Shutdown() {}
+
+// newTestClient returns a Client sharing a testPKIClient between sessions
+// made of newTestSession.
+func newTestClient(t *testing.T) *Client {
+	cfg := &config.Config{
+		Logging: &config.Logging{Disable: true, Level: "ERROR"},
+		Debug:   &config.Debug{SessionDialTimeout: 1},
+		Account: &config.Account{User: "alice", Provider: "provider1"},
+	}
+	c, err := New(cfg, "")
+	require.NoError(t, err)
+	pkiClient := testPKIClient{}
+	c.pkiClient = pkiClient
+	c.pkiCache = kpki.NewCacheClient(pkiClient)
+	c.newSession = func(ctx context.Context, fatalErrCh chan error, logBackend *log.Backend, cfg *config.Config, linkKey *ecdh.PrivateKey, pkiClient kpki.Client, opts ...SessionOption) (*Session, error) {
+		s := newTestSession(clock.Real, newTestMinclient(nil))
+		s.fatalErrCh = fatalErrCh
+		s.pkiClient = pkiClient
+		s.account = cfg.Account
+		s.arqTimerQueue = NewTimerQueue(&arqRetransmitter{s: s})
+		return s, nil
+	}
+	return c
+}
+
+func newTestIdentity(t *testing.T, user string) *Identity {
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(t, err)
+	return &Identity{
+		LinkKey: linkKey,
+		Account: &config.Account{User: user, Provider: "provider1"},
+	}
+}
+
+func assertClientRunning(t *testing.T, c *Client) {
+	select {
+	case <-c.haltedCh:
+		t.Fatal("client shut down")
+	default:
+	}
+}
+
+func TestClientAccountSessions(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	c := newTestClient(t)
+	alice := newTestIdentity(t, "alice")
+	bob := newTestIdentity(t, "bob")
+	aliceSession, err := c.NewAccountSession(alice)
+	require.NoError(err)
+	bobSession, err := c.NewAccountSession(bob)
+	require.NoError(err)
+	_, err = c.NewAccountSession(alice)
+	assert.Error(err)
+
+	// both accounts share the PKI cache
+	assert.True(aliceSession.pkiClient == c.pkiCache)
+	assert.True(bobSession.pkiClient == c.pkiCache)
+	assert.Len(c.Sessions(), 2)
+	session, ok := c.GetSession(AccountID(bob.Account))
+	assert.True(ok)
+	assert.True(session == bobSession)
+
+	// a fatal error only shuts down the session of bob
+	bobSession.fatal(errors.New("connection lost"))
+	<-bobSession.HaltCh()
+	_, ok = c.GetSession(AccountID(bob.Account))
+	assert.False(ok)
+	assertClientRunning(t, c)
+	_, ok = c.GetSession(AccountID(alice.Account))
+	assert.True(ok)
+
+	// the Client is shut down along with its last session
+	aliceSession.fatal(errors.New("connection lost"))
+	c.Wait()
+	assert.Empty(c.Sessions())
+}
+
+func TestClientDefaultSessionFatal(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	c := newTestClient(t)
+	bob := newTestIdentity(t, "bob")
+	bobSession, err := c.NewAccountSession(bob)
+	require.NoError(err)
+	defaultSession, err := c.NewSession(newTestIdentity(t, "alice").LinkKey)
+	require.NoError(err)
+	assert.True(defaultSession == c.defaultSession())
+
+	// closing another session keeps the Client running
+	require.NoError(c.CloseAccountSession(AccountID(bob.Account)))
+	<-bobSession.HaltCh()
+	assertClientRunning(t, c)
+
+	bobSession, err = c.NewAccountSession(bob)
+	require.NoError(err)
+	defaultSession.fatal(errors.New("connection lost"))
+	c.Wait()
+	<-bobSession.HaltCh()
+	assert.Nil(c.defaultSession())
+	_, err = c.SendRawTransaction(context.Background(), "eth", []byte{0x01})
+	assert.Equal(ErrNotStarted, err)
+}
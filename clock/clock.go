@@ -0,0 +1,205 @@
+// clock.go - Injectable clock.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package clock abstracts the passing of time so that time dependent code
+// can be tested deterministically with a Fake clock.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current
+	// time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer creates a new Timer that will send the current time on its
+	// channel after at least duration d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event timer, see time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+
+	// Stop prevents the Timer from firing, it returns false if the timer
+	// already expired or was stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d, it returns true
+	// if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// Real is the Clock of the system.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return &realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Fake is a Clock whose time only passes when advanced.  Its timers fire
+// synchronously from Advance and Set.
+type Fake struct {
+	sync.Mutex
+
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+	cond   *sync.Cond
+}
+
+// NewFake returns a new Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{
+		now:    now,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+	f.cond = sync.NewCond(&f.Mutex)
+	return f
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+// After implements Clock.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer implements Clock.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		clock: f,
+		ch:    make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers which expire in
+// deadline order.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set sets the clock to now, firing the timers which expire in deadline
+// order.
+func (f *Fake) Set(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.now = now
+	expired := make([]*fakeTimer, 0, len(f.timers))
+	for t := range f.timers {
+		if !t.deadline.After(now) {
+			expired = append(expired, t)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].deadline.Before(expired[j].deadline)
+	})
+	for _, t := range expired {
+		f.fire(t)
+	}
+}
+
+// Timers returns the number of active timers.
+func (f *Fake) Timers() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.timers)
+}
+
+// BlockUntil blocks until at least n timers are active, which lets tests
+// wait for a goroutine to arm its timers before advancing the clock.
+func (f *Fake) BlockUntil(n int) {
+	f.Lock()
+	defer f.Unlock()
+	for len(f.timers) < n {
+		f.cond.Wait()
+	}
+}
+
+// fire must be called with the lock held.
+func (f *Fake) fire(t *fakeTimer) {
+	delete(f.timers, t)
+	select {
+	case t.ch <- f.now:
+	default:
+	}
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	ch       chan time.Time
+	deadline time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.Lock()
+	defer t.clock.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.clock
+	f.Lock()
+	defer f.Unlock()
+	_, active := f.timers[t]
+	t.deadline = f.now.Add(d)
+	f.timers[t] = struct{}{}
+	if d <= 0 {
+		f.fire(t)
+	} else {
+		f.cond.Broadcast()
+	}
+	return active
+}
@@ -0,0 +1,68 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Unix(1000, 0)
+	f := NewFake(start)
+	assert.Equal(start, f.Now())
+
+	late := f.NewTimer(2 * time.Second)
+	early := f.NewTimer(time.Second)
+	stopped := f.NewTimer(time.Second)
+	assert.Equal(3, f.Timers())
+	assert.True(stopped.Stop())
+	assert.False(stopped.Stop())
+
+	f.Advance(time.Second)
+	assert.Equal(start.Add(time.Second), <-early.C())
+	select {
+	case <-late.C():
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	// resetting an active timer postpones it
+	assert.True(late.Reset(2 * time.Second))
+	f.Advance(time.Second)
+	assert.Equal(1, f.Timers())
+	f.Advance(time.Second)
+	assert.Equal(start.Add(3*time.Second), <-late.C())
+	assert.False(late.Reset(0))
+	<-late.C()
+
+	ch := f.After(time.Minute)
+	go f.Advance(time.Minute)
+	assert.Equal(start.Add(3*time.Second+time.Minute), <-ch)
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Now())
+	done := make(chan struct{})
+	go func() {
+		<-f.After(time.Second)
+		close(done)
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-done
+}
+
+func TestReal(t *testing.T) {
+	assert := assert.New(t)
+
+	timer := Real.NewTimer(time.Millisecond)
+	<-timer.C()
+	assert.False(timer.Stop())
+	assert.False(timer.Reset(time.Hour))
+	assert.True(timer.Stop())
+}
@@ -0,0 +1,66 @@
+// clock_skew.go - Provider clock skew handling.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"time"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/client/constants"
+)
+
+// newClockSkewEvent returns the event reporting the clock skew observed
+// against the Provider, handled according to the configuration.
+func newClockSkewEvent(skew time.Duration, cfg *config.TimeSync) *ClockSkewEvent {
+	e := &ClockSkewEvent{
+		Skew: skew,
+	}
+	if cfg == nil {
+		return e
+	}
+	e.Corrected = cfg.Enable
+	absSkew := skew
+	if absSkew < 0 {
+		absSkew = -absSkew
+	}
+	if cfg.MaxClockSkew > 0 && absSkew > time.Duration(cfg.MaxClockSkew)*time.Second {
+		e.Unsafe = true
+	}
+	return e
+}
+
+// checkClockSkew reports the clock skew observed by the current minclient
+// instance upon connecting, and returns false if it is unsafe to send.
+func (s *Session) checkClockSkew() bool {
+	e := newClockSkewEvent(s.currentMinclient().ClockSkew(), s.cfg.TimeSync)
+	absSkew := e.Skew
+	if absSkew < 0 {
+		absSkew = -absSkew
+	}
+	switch {
+	case e.Unsafe:
+		s.log.Errorf("The observed time difference between the host and provider clocks is '%v', refusing to send. Correct your system time.", e.Skew)
+	case absSkew <= constants.TimeSkewWarnDelta:
+		s.log.Debugf("Clock skew vs provider: %v", e.Skew)
+	case e.Corrected:
+		s.log.Noticef("Correcting the observed time difference between the host and provider clocks of '%v'.", e.Skew)
+	default:
+		s.log.Warningf("The observed time difference between the host and provider clocks is '%v'. Correct your system time.", e.Skew)
+	}
+	s.eventCh.In() <- e
+	return !e.Unsafe
+}
@@ -0,0 +1,31 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClockSkewEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	e := newClockSkewEvent(time.Hour, nil)
+	assert.False(e.Corrected)
+	assert.False(e.Unsafe)
+
+	cfg := &config.TimeSync{
+		Enable:       true,
+		MaxClockSkew: 60,
+	}
+	e = newClockSkewEvent(-time.Minute, cfg)
+	assert.True(e.Corrected)
+	assert.False(e.Unsafe)
+	e = newClockSkewEvent(-2*time.Minute, cfg)
+	assert.True(e.Unsafe)
+	assert.Equal(-2*time.Minute, e.Skew)
+
+	cfg.MaxClockSkew = 0
+	assert.False(newClockSkewEvent(time.Hour, cfg).Unsafe)
+}
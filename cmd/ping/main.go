@@ -19,20 +19,33 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 
 	client "github.com/hashcloak/Meson-client"
 	"github.com/hashcloak/Meson-client/config"
 	"github.com/katzenpost/core/crypto/ecdh"
 )
 
-func register(configFile string) (*config.Config, *ecdh.PrivateKey) {
+// passphraseEnv is the environment variable holding the keystore passphrase.
+const passphraseEnv = "MESON_KEYSTORE_PASSPHRASE"
+
+func register(configFile, passphrase string) (*config.Config, *ecdh.PrivateKey) {
 	cfg, err := config.LoadFile(configFile)
 	if err != nil {
 		panic(err)
 	}
 	_ = cfg.UpdateTrust()
 	_ = cfg.SaveConfig(configFile)
-	linkKey := client.AutoRegisterRandomClient(cfg)
+	if cfg.Keystore != nil {
+		if passphrase == "" {
+			panic(passphraseEnv + " must be set to use the keystore")
+		}
+		cfg.Keystore.Passphrase = passphrase
+	}
+	linkKey, err := client.LoadOrRegisterClient(cfg)
+	if err != nil {
+		panic(err)
+	}
 	return cfg, linkKey
 }
 
@@ -47,7 +60,7 @@ func main() {
 		panic("must specify service name with -s")
 	}
 
-	cfg, linkKey := register(configFile)
+	cfg, linkKey := register(configFile, os.Getenv(passphraseEnv))
 
 	// create a client and connect to the mixnet Provider
 	c, err := client.NewFromConfig(cfg, service)
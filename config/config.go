@@ -42,6 +42,49 @@ const (
 	defaultPollingInterval             = 10
 	defaultInitialMaxPKIRetrievalDelay = 30
 	defaultSessionDialTimeout          = 30
+	defaultMaxRetransmissions          = 5
+	defaultLoopDecoyLossThreshold      = 0.25
+	defaultTrafficBurstDuration        = 60
+	defaultTrafficIdleDuration         = 300
+	defaultFailoverMaxMissingEpochs    = 2
+	defaultFailoverMaxConnectFailures  = 5
+)
+
+const (
+	// EgressQueueMemory is the in-memory egress queue backend.
+	EgressQueueMemory = "memory"
+
+	// EgressQueueLevelDB is the LevelDB backed persistent egress queue
+	// backend.
+	EgressQueueLevelDB = "leveldb"
+
+	// EgressQueuePriority is the in-memory priority egress queue backend.
+	EgressQueuePriority = "priority"
+)
+
+const (
+	// MissingLoopServiceReject rejects the PKI documents with a Provider
+	// lacking the loop service.
+	MissingLoopServiceReject = "reject"
+
+	// MissingLoopServiceIgnore only sends loop decoys to the Providers
+	// with the loop service.
+	MissingLoopServiceIgnore = "ignore"
+
+	// MissingLoopServiceDisableDecoys disables the decoy traffic while
+	// a Provider lacks the loop service.
+	MissingLoopServiceDisableDecoys = "disable_decoys"
+)
+
+const (
+	// TrafficPoisson is the Poisson traffic scheduler.
+	TrafficPoisson = "poisson"
+
+	// TrafficConstant is the constant rate traffic scheduler.
+	TrafficConstant = "constant"
+
+	// TrafficBurst is the burst then idle traffic scheduler.
+	TrafficBurst = "burst"
 )
 
 var defaultLogging = Logging{
@@ -101,6 +144,17 @@ type Debug struct {
 	// PreferedTransports is a list of the transports will be used to make
 	// outgoing network connections, with the most prefered first.
 	PreferedTransports []cpki.Transport
+
+	// MaxRetransmissions is the maximum number of times a reliable
+	// message is retransmitted when no reply is received.  By default
+	// this is 5, 0 disables the retransmissions.
+	MaxRetransmissions *int
+
+	// LoopDecoyLossThreshold is the fraction of the loop decoys sent in an
+	// epoch which may be lost before a warning is logged, as it can
+	// indicate an n-1 or dropping attack against the client.  By default
+	// this is 0.25, 0 warns of any loss.
+	LoopDecoyLossThreshold *float64
 }
 
 func (d *Debug) fixup() {
@@ -113,6 +167,24 @@ func (d *Debug) fixup() {
 	if d.SessionDialTimeout == 0 {
 		d.SessionDialTimeout = defaultSessionDialTimeout
 	}
+	if d.MaxRetransmissions == nil {
+		maxRetransmissions := defaultMaxRetransmissions
+		d.MaxRetransmissions = &maxRetransmissions
+	}
+	if d.LoopDecoyLossThreshold == nil {
+		lossThreshold := defaultLoopDecoyLossThreshold
+		d.LoopDecoyLossThreshold = &lossThreshold
+	}
+}
+
+func (d *Debug) validate() error {
+	if *d.MaxRetransmissions < 0 {
+		return errors.New("MaxRetransmissions cannot be negative")
+	}
+	if *d.LoopDecoyLossThreshold < 0 || *d.LoopDecoyLossThreshold > 1 {
+		return errors.New("LoopDecoyLossThreshold must be between 0 and 1")
+	}
+	return nil
 }
 
 // Katzenmint is a tendermint client configuration.
@@ -237,10 +309,67 @@ func (accCfg *Account) validate() error {
 	return nil
 }
 
+// ProviderSelection is the policy used to pick the Provider a client
+// registers with.
+type ProviderSelection struct {
+	// Provider, if set, pins the client to the named Provider.
+	Provider string
+
+	// Allow, if not empty, restricts the client to the listed Providers.
+	Allow []string
+
+	// Deny excludes the listed Providers.
+	Deny []string
+
+	// PreferService makes Providers advertising the named Kaetzchen
+	// service preferred over the others.
+	PreferService string
+}
+
+func (p *ProviderSelection) validate() error {
+	if p.Provider != "" && !p.Permits(p.Provider) {
+		return fmt.Errorf("pinned Provider '%v' is not permitted by Allow/Deny", p.Provider)
+	}
+	return nil
+}
+
+// Permits returns true iff the policy allows using the named Provider.
+func (p *ProviderSelection) Permits(name string) bool {
+	if p.Provider != "" && p.Provider != name {
+		return false
+	}
+	for _, denied := range p.Deny {
+		if denied == name {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range p.Allow {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Registration is used for the client's Provider account registration.
 type Registration struct {
 	Address string
 	Options *registration.Options
+
+	// Selection is the optional Provider selection policy.
+	Selection *ProviderSelection
+}
+
+// PermitsProvider returns true iff the Provider selection policy, if any,
+// allows using the named Provider.
+func (r *Registration) PermitsProvider(name string) bool {
+	if r == nil || r.Selection == nil {
+		return true
+	}
+	return r.Selection.Permits(name)
 }
 
 func (r *Registration) validate() error {
@@ -250,6 +379,208 @@ func (r *Registration) validate() error {
 	return nil
 }
 
+// Keystore is the persistent client identity keystore configuration.
+type Keystore struct {
+	// File is the path of the passphrase encrypted keystore file holding
+	// the link key and the account the client is registered with.
+	File string
+
+	// Passphrase is the passphrase used to encrypt and decrypt the
+	// keystore, which must not be empty.  It is never read from nor
+	// written to the configuration file and must be set at runtime, for
+	// instance from the environment.
+	Passphrase string `toml:"-"`
+}
+
+func (k *Keystore) validate() error {
+	if k.File == "" {
+		return errors.New("keystore File cannot be empty")
+	}
+	return nil
+}
+
+// Failover is the Provider failover configuration.
+type Failover struct {
+	// Enable enables registering with another Provider when ours
+	// disappears from the PKI document or cannot be connected to.
+	Enable bool
+
+	// MaxMissingEpochs is the number of consecutive epochs our Provider
+	// may be missing from the PKI document before failing over.
+	MaxMissingEpochs int
+
+	// MaxConnectFailures is the number of consecutive connection failures
+	// tolerated before failing over.
+	MaxConnectFailures int
+}
+
+func (f *Failover) fixup() {
+	if f.MaxMissingEpochs == 0 {
+		f.MaxMissingEpochs = defaultFailoverMaxMissingEpochs
+	}
+	if f.MaxConnectFailures == 0 {
+		f.MaxConnectFailures = defaultFailoverMaxConnectFailures
+	}
+}
+
+func (f *Failover) validate() error {
+	if f.MaxMissingEpochs < 0 {
+		return errors.New("failover MaxMissingEpochs cannot be negative")
+	}
+	if f.MaxConnectFailures < 0 {
+		return errors.New("failover MaxConnectFailures cannot be negative")
+	}
+	return nil
+}
+
+// EgressQueue is the egress queue configuration.
+type EgressQueue struct {
+	// Backend is the egress queue backend, "memory" (the default),
+	// "priority" which sends messages with a higher QueuePriority first,
+	// or "leveldb" which also does, and keeps queued messages across
+	// restarts, encrypted with a key derived from the link key.
+	Backend string
+
+	// Directory is the directory the "leveldb" backend stores its
+	// database in.
+	Directory string
+
+	// AgingInterval is the number of seconds after which the "priority"
+	// and "leveldb" backends raise the priority of a queued message by
+	// one, so that low priority messages are eventually sent.
+	AgingInterval int
+}
+
+func (e *EgressQueue) validate() error {
+	if e.AgingInterval < 0 {
+		return errors.New("egress queue AgingInterval cannot be negative")
+	}
+	switch e.Backend {
+	case "", EgressQueueMemory, EgressQueuePriority:
+	case EgressQueueLevelDB:
+		if e.Directory == "" {
+			return errors.New("egress queue Directory cannot be empty")
+		}
+	default:
+		return fmt.Errorf("invalid egress queue Backend '%v'", e.Backend)
+	}
+	return nil
+}
+
+// Traffic is the cover traffic configuration.
+type Traffic struct {
+	// Scheduler is the traffic scheduler, "poisson" (the default) which
+	// follows the Poisson processes of the PKI document, "constant" which
+	// sends at their mean rates or "burst" which follows them during
+	// bursts separated by idle periods.
+	Scheduler string
+
+	// BurstDuration is the number of seconds the bursts of the "burst"
+	// scheduler last.
+	BurstDuration int
+
+	// IdleDuration is the number of seconds the "burst" scheduler stays
+	// idle between bursts.
+	IdleDuration int
+}
+
+func (t *Traffic) fixup() {
+	if t.BurstDuration == 0 {
+		t.BurstDuration = defaultTrafficBurstDuration
+	}
+	if t.IdleDuration == 0 {
+		t.IdleDuration = defaultTrafficIdleDuration
+	}
+}
+
+func (t *Traffic) validate() error {
+	if t.BurstDuration < 0 {
+		return errors.New("traffic BurstDuration cannot be negative")
+	}
+	if t.IdleDuration < 0 {
+		return errors.New("traffic IdleDuration cannot be negative")
+	}
+	switch t.Scheduler {
+	case "", TrafficPoisson, TrafficConstant, TrafficBurst:
+	default:
+		return fmt.Errorf("invalid traffic Scheduler '%v'", t.Scheduler)
+	}
+	return nil
+}
+
+// Bandwidth is the bandwidth budget configuration.  The decoy traffic is
+// reduced first, then the real sends, to stay within the budget.
+type Bandwidth struct {
+	// PacketsPerHour is the maximum number of Sphinx packets sent per
+	// hour, 0 for no limit.
+	PacketsPerHour int
+
+	// BytesPerDay is the maximum number of Sphinx packet bytes sent per
+	// day, 0 for no limit.
+	BytesPerDay int64
+}
+
+func (b *Bandwidth) validate() error {
+	if b.PacketsPerHour < 0 {
+		return errors.New("bandwidth PacketsPerHour cannot be negative")
+	}
+	if b.BytesPerDay < 0 {
+		return errors.New("bandwidth BytesPerDay cannot be negative")
+	}
+	if b.PacketsPerHour == 0 && b.BytesPerDay == 0 {
+		return errors.New("bandwidth budget has no limit")
+	}
+	return nil
+}
+
+// TimeSync is the Provider clock skew handling configuration.
+type TimeSync struct {
+	// Enable composes the Sphinx packets with the host time corrected by
+	// the clock skew observed against the Provider.
+	Enable bool
+
+	// MaxClockSkew is the clock skew in seconds beyond which nothing is
+	// sent, as the Sphinx delays and the epoch keys of the packets could
+	// be rejected by the mixes, 0 to send regardless of the skew.
+	MaxClockSkew int
+}
+
+func (t *TimeSync) validate() error {
+	if t.MaxClockSkew < 0 {
+		return errors.New("time sync MaxClockSkew cannot be negative")
+	}
+	return nil
+}
+
+// DocumentPolicy is the PKI document acceptance policy configuration.
+type DocumentPolicy struct {
+	// MissingLoopService is what to do when a Provider lacks the loop
+	// service, "reject" (the default) the document, "ignore" the
+	// Provider for loop decoys or "disable_decoys".
+	MissingLoopService string
+
+	// MinLayers is the minimum number of mix layers.
+	MinLayers int
+
+	// MinProviders is the minimum number of Providers.
+	MinProviders int
+
+	// MinMixesPerLayer is the minimum number of mixes in each layer.
+	MinMixesPerLayer int
+}
+
+func (d *DocumentPolicy) validate() error {
+	if d.MinLayers < 0 || d.MinProviders < 0 || d.MinMixesPerLayer < 0 {
+		return errors.New("document policy minimums cannot be negative")
+	}
+	switch d.MissingLoopService {
+	case "", MissingLoopServiceReject, MissingLoopServiceIgnore, MissingLoopServiceDisableDecoys:
+	default:
+		return fmt.Errorf("invalid document policy MissingLoopService '%v'", d.MissingLoopService)
+	}
+	return nil
+}
+
 // UpstreamProxy is the outgoing connection proxy configuration.
 type UpstreamProxy struct {
 	// Type is the proxy type (Eg: "none"," socks5").
@@ -292,9 +623,17 @@ type Config struct {
 	Katzenmint    *Katzenmint
 	Account       *Account
 	Registration  *Registration
-	Panda         *Panda
-	Reunion       *Reunion
-	upstreamProxy *proxy.Config
+	Keystore      *Keystore
+	Failover      *Failover
+	EgressQueue   *EgressQueue
+	Traffic       *Traffic
+	Bandwidth     *Bandwidth
+
+	DocumentPolicy *DocumentPolicy
+	TimeSync       *TimeSync
+	Panda          *Panda
+	Reunion        *Reunion
+	upstreamProxy  *proxy.Config
 }
 
 // UpstreamProxyConfig returns the configured upstream proxy, suitable for
@@ -311,18 +650,17 @@ func (c *Config) FixupAndMinimallyValidate() error {
 		c.Logging = &defaultLogging
 	}
 	if c.Debug == nil {
-		c.Debug = &Debug{
-			PollingInterval:             defaultPollingInterval,
-			InitialMaxPKIRetrievalDelay: defaultInitialMaxPKIRetrievalDelay,
-		}
-	} else {
-		c.Debug.fixup()
+		c.Debug = new(Debug)
 	}
+	c.Debug.fixup()
 
 	// Validate/fixup the various sections.
 	if err := c.Logging.validate(); err != nil {
 		return err
 	}
+	if err := c.Debug.validate(); err != nil {
+		return fmt.Errorf("config: Debug is invalid: %v", err)
+	}
 	if uCfg, err := c.UpstreamProxy.toProxyConfig(); err == nil {
 		c.upstreamProxy = uCfg
 	} else {
@@ -332,6 +670,72 @@ func (c *Config) FixupAndMinimallyValidate() error {
 		return fmt.Errorf("config: Katzenmint is invalid: %v", err)
 	}
 
+	// Keystore is optional
+	if c.Keystore != nil {
+		err := c.Keystore.validate()
+		if err != nil {
+			return fmt.Errorf("config: Keystore config is invalid: %v", err)
+		}
+	}
+
+	// The Provider selection policy is optional
+	if c.Registration != nil && c.Registration.Selection != nil {
+		err := c.Registration.Selection.validate()
+		if err != nil {
+			return fmt.Errorf("config: Registration Selection is invalid: %v", err)
+		}
+	}
+
+	// Failover is optional
+	if c.Failover != nil {
+		c.Failover.fixup()
+		err := c.Failover.validate()
+		if err != nil {
+			return fmt.Errorf("config: Failover config is invalid: %v", err)
+		}
+	}
+
+	// EgressQueue is optional
+	if c.EgressQueue != nil {
+		err := c.EgressQueue.validate()
+		if err != nil {
+			return fmt.Errorf("config: EgressQueue config is invalid: %v", err)
+		}
+	}
+
+	// Traffic is optional
+	if c.Traffic != nil {
+		c.Traffic.fixup()
+		err := c.Traffic.validate()
+		if err != nil {
+			return fmt.Errorf("config: Traffic config is invalid: %v", err)
+		}
+	}
+
+	// Bandwidth is optional
+	if c.Bandwidth != nil {
+		err := c.Bandwidth.validate()
+		if err != nil {
+			return fmt.Errorf("config: Bandwidth config is invalid: %v", err)
+		}
+	}
+
+	// DocumentPolicy is optional
+	if c.DocumentPolicy != nil {
+		err := c.DocumentPolicy.validate()
+		if err != nil {
+			return fmt.Errorf("config: DocumentPolicy config is invalid: %v", err)
+		}
+	}
+
+	// TimeSync is optional
+	if c.TimeSync != nil {
+		err := c.TimeSync.validate()
+		if err != nil {
+			return fmt.Errorf("config: TimeSync config is invalid: %v", err)
+		}
+	}
+
 	// Panda is optional
 	if c.Panda != nil {
 		err := c.Panda.validate()
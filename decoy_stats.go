@@ -0,0 +1,156 @@
+// decoy_stats.go - Loop decoy loss and latency statistics.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+// minLoopDecoySamples is the minimum number of loop decoys sent in an epoch
+// for its loss to be compared against the threshold.
+const minLoopDecoySamples = 4
+
+// epochDecoyStats are the loop decoy statistics of an epoch.
+type epochDecoyStats struct {
+	sent         int
+	returned     int
+	lost         int
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+func (e *epochDecoyStats) pending() int {
+	return e.sent - e.returned - e.lost
+}
+
+// loopDecoyStats tracks the loop decoys in flight and accounts for them in
+// the epoch they were sent in.
+type loopDecoyStats struct {
+	sync.Mutex
+
+	inFlight map[[cConstants.MessageIDLength]byte]uint64
+	epochs   map[uint64]*epochDecoyStats
+}
+
+func newLoopDecoyStats() *loopDecoyStats {
+	return &loopDecoyStats{
+		inFlight: make(map[[cConstants.MessageIDLength]byte]uint64),
+		epochs:   make(map[uint64]*epochDecoyStats),
+	}
+}
+
+func (l *loopDecoyStats) sent(id *[cConstants.MessageIDLength]byte, epoch uint64) {
+	l.Lock()
+	defer l.Unlock()
+	e, ok := l.epochs[epoch]
+	if !ok {
+		e = new(epochDecoyStats)
+		l.epochs[epoch] = e
+	}
+	e.sent++
+	l.inFlight[*id] = epoch
+}
+
+func (l *loopDecoyStats) returned(id *[cConstants.MessageIDLength]byte, latency time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	epoch, ok := l.inFlight[*id]
+	if !ok {
+		return
+	}
+	delete(l.inFlight, *id)
+	e := l.epochs[epoch]
+	e.returned++
+	e.totalLatency += latency
+	if latency > e.maxLatency {
+		e.maxLatency = latency
+	}
+}
+
+func (l *loopDecoyStats) lost(id *[cConstants.MessageIDLength]byte) {
+	l.Lock()
+	defer l.Unlock()
+	epoch, ok := l.inFlight[*id]
+	if !ok {
+		return
+	}
+	delete(l.inFlight, *id)
+	l.epochs[epoch].lost++
+}
+
+// finalize removes and returns the statistics of the epochs prior to
+// currentEpoch whose loop decoys all returned or were lost, oldest first.
+func (l *loopDecoyStats) finalize(currentEpoch uint64, threshold float64) []*LoopDecoyStatsEvent {
+	l.Lock()
+	defer l.Unlock()
+	var events []*LoopDecoyStatsEvent
+	for epoch, e := range l.epochs {
+		if epoch >= currentEpoch || e.pending() > 0 {
+			continue
+		}
+		delete(l.epochs, epoch)
+		ev := &LoopDecoyStatsEvent{
+			Epoch:      epoch,
+			Sent:       e.sent,
+			Returned:   e.returned,
+			Lost:       e.lost,
+			MaxLatency: e.maxLatency,
+		}
+		if e.sent > 0 {
+			ev.Loss = float64(e.lost) / float64(e.sent)
+		}
+		if e.returned > 0 {
+			ev.MeanLatency = e.totalLatency / time.Duration(e.returned)
+		}
+		ev.ExceedsThreshold = e.sent >= minLoopDecoySamples && ev.Loss > threshold
+		events = append(events, ev)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Epoch < events[j].Epoch
+	})
+	return events
+}
+
+// reportLoopDecoyStats emits the statistics of the completed epochs.
+func (s *Session) reportLoopDecoyStats() {
+	doc := s.CurrentDocument()
+	if doc == nil {
+		return
+	}
+	for _, ev := range s.decoyStats.finalize(doc.Epoch, s.loopDecoyLossThreshold()) {
+		if ev.ExceedsThreshold {
+			s.log.Warningf("Lost %d of %d loop decoys in epoch %d, the client may be under an active attack", ev.Lost, ev.Sent, ev.Epoch)
+		} else {
+			s.log.Debugf("Lost %d of %d loop decoys in epoch %d", ev.Lost, ev.Sent, ev.Epoch)
+		}
+		s.eventCh.In() <- ev
+	}
+}
+
+// loopDecoyLossThreshold returns the configured loop decoy loss threshold,
+// which any loss exceeds unless the configuration was fixed up.
+func (s *Session) loopDecoyLossThreshold() float64 {
+	if t := s.cfg.Debug.LoopDecoyLossThreshold; t != nil {
+		return math.Max(0, *t)
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopDecoyStats(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	stats := newLoopDecoyStats()
+	for i := byte(0); i < 4; i++ {
+		stats.sent(newTestMessage(i).ID, 10)
+	}
+	stats.sent(newTestMessage(4).ID, 11)
+	stats.returned(newTestMessage(0).ID, 2*time.Second)
+	stats.returned(newTestMessage(1).ID, 4*time.Second)
+	stats.lost(newTestMessage(2).ID)
+
+	// epochs are reported once over and without decoys in flight
+	assert.Empty(stats.finalize(11, 0.25))
+	stats.lost(newTestMessage(3).ID)
+	assert.Empty(stats.finalize(10, 0.25))
+	events := stats.finalize(11, 0.25)
+	require.Len(events, 1)
+	ev := events[0]
+	assert.Equal(uint64(10), ev.Epoch)
+	assert.Equal(4, ev.Sent)
+	assert.Equal(2, ev.Returned)
+	assert.Equal(2, ev.Lost)
+	assert.Equal(0.5, ev.Loss)
+	assert.Equal(3*time.Second, ev.MeanLatency)
+	assert.Equal(4*time.Second, ev.MaxLatency)
+	assert.True(ev.ExceedsThreshold)
+	assert.Empty(stats.finalize(11, 0.25))
+
+	// too few decoys to tell
+	stats.lost(newTestMessage(4).ID)
+	events = stats.finalize(12, 0.25)
+	require.Len(events, 1)
+	assert.Equal(1.0, events[0].Loss)
+	assert.False(events[0].ExceedsThreshold)
+}
+
+func TestLoopDecoyStrictThreshold(t *testing.T) {
+	assert := assert.New(t)
+
+	strict, lenient := 0.0, 0.5
+	s := &Session{cfg: &config.Config{Debug: &config.Debug{LoopDecoyLossThreshold: &lenient}}}
+	assert.Equal(0.5, s.loopDecoyLossThreshold())
+	s.cfg.Debug.LoopDecoyLossThreshold = &strict
+	threshold := s.loopDecoyLossThreshold()
+	assert.Equal(0.0, threshold)
+
+	stats := newLoopDecoyStats()
+	for i := byte(0); i < 8; i++ {
+		stats.sent(newTestMessage(i).ID, 10)
+		if i == 0 {
+			stats.lost(newTestMessage(i).ID)
+		} else {
+			stats.returned(newTestMessage(i).ID, time.Second)
+		}
+	}
+	events := stats.finalize(11, threshold)
+	assert.Len(events, 1)
+	assert.True(events[0].ExceedsThreshold)
+
+	// without loss the strict threshold is not exceeded
+	stats.sent(newTestMessage(9).ID, 11)
+	for i := byte(10); i < 14; i++ {
+		stats.sent(newTestMessage(i).ID, 11)
+		stats.returned(newTestMessage(i).ID, time.Second)
+	}
+	stats.returned(newTestMessage(9).ID, time.Second)
+	events = stats.finalize(12, threshold)
+	assert.Len(events, 1)
+	assert.False(events[0].ExceedsThreshold)
+}
@@ -0,0 +1,147 @@
+// document_policy.go - PKI document acceptance policy.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/pki"
+)
+
+// DocumentAction is what the session does with a PKI document.
+type DocumentAction int
+
+const (
+	// AcceptDocument uses the document.
+	AcceptDocument DocumentAction = iota
+
+	// AcceptDocumentWithoutDecoys uses the document but sends no decoy
+	// traffic while it is current.
+	AcceptDocumentWithoutDecoys
+
+	// RejectDocument sends no traffic until an acceptable document is
+	// published.
+	RejectDocument
+)
+
+// String returns a string representation of a DocumentAction.
+func (a DocumentAction) String() string {
+	switch a {
+	case AcceptDocument:
+		return "accept"
+	case AcceptDocumentWithoutDecoys:
+		return "accept without decoys"
+	case RejectDocument:
+		return "reject"
+	}
+	return "unknown"
+}
+
+// DocumentPolicy decides what the session does with each PKI document.
+type DocumentPolicy interface {
+	// CheckDocument returns the action to take for the document, along
+	// with the reason for any action but AcceptDocument.
+	CheckDocument(doc *pki.Document) (DocumentAction, error)
+}
+
+// ConfigDocumentPolicy is the DocumentPolicy of the DocumentPolicy
+// configuration section.
+type ConfigDocumentPolicy struct {
+	cfg config.DocumentPolicy
+}
+
+// NewConfigDocumentPolicy returns a new ConfigDocumentPolicy, which
+// rejects documents with a Provider lacking the loop service if cfg is
+// nil.
+func NewConfigDocumentPolicy(cfg *config.DocumentPolicy) *ConfigDocumentPolicy {
+	p := new(ConfigDocumentPolicy)
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+	return p
+}
+
+// CheckDocument implements DocumentPolicy.
+func (p *ConfigDocumentPolicy) CheckDocument(doc *pki.Document) (DocumentAction, error) {
+	if len(doc.Topology) < p.cfg.MinLayers {
+		return RejectDocument, fmt.Errorf("document has %d layers, %d required", len(doc.Topology), p.cfg.MinLayers)
+	}
+	if len(doc.Providers) < p.cfg.MinProviders {
+		return RejectDocument, fmt.Errorf("document has %d Providers, %d required", len(doc.Providers), p.cfg.MinProviders)
+	}
+	for i, layer := range doc.Topology {
+		if len(layer) < p.cfg.MinMixesPerLayer {
+			return RejectDocument, fmt.Errorf("layer %d has %d mixes, %d required", i, len(layer), p.cfg.MinMixesPerLayer)
+		}
+	}
+
+	missing := 0
+	for _, provider := range doc.Providers {
+		if _, ok := provider.Kaetzchen[constants.LoopService]; !ok {
+			missing++
+		}
+	}
+	if missing == 0 {
+		return AcceptDocument, nil
+	}
+	err := fmt.Errorf("%d of %d Providers do not have the loop service", missing, len(doc.Providers))
+	switch p.cfg.MissingLoopService {
+	case config.MissingLoopServiceIgnore:
+		// Loop decoys are only sent to the Providers with the loop
+		// service, see GetService.
+		if missing < len(doc.Providers) {
+			return AcceptDocument, nil
+		}
+		return AcceptDocumentWithoutDecoys, err
+	case config.MissingLoopServiceDisableDecoys:
+		return AcceptDocumentWithoutDecoys, err
+	default:
+		return RejectDocument, err
+	}
+}
+
+// SetDocumentPolicy replaces the policy applied to the PKI documents
+// published from now on.
+func (s *Session) SetDocumentPolicy(policy DocumentPolicy) {
+	s.docPolicyLock.Lock()
+	defer s.docPolicyLock.Unlock()
+	s.docPolicy = policy
+}
+
+func (s *Session) checkDocument(doc *pki.Document) (DocumentAction, error) {
+	s.docPolicyLock.RLock()
+	defer s.docPolicyLock.RUnlock()
+	return s.docPolicy.CheckDocument(doc)
+}
+
+// applyDocumentPolicy checks the document and reports any action but
+// AcceptDocument.
+func (s *Session) applyDocumentPolicy(doc *pki.Document) DocumentAction {
+	action, err := s.checkDocument(doc)
+	if action == AcceptDocument {
+		return action
+	}
+	s.log.Warningf("PKI document for epoch %d: %v: %v", doc.Epoch, action, err)
+	s.eventCh.In() <- &DocumentPolicyEvent{
+		Epoch:  doc.Epoch,
+		Action: action,
+		Err:    err,
+	}
+	return action
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPolicyDocument(layers, mixesPerLayer, providers, loopProviders int) *pki.Document {
+	doc := &pki.Document{Epoch: 1}
+	for i := 0; i < layers; i++ {
+		layer := make([]*pki.MixDescriptor, mixesPerLayer)
+		for j := range layer {
+			layer[j] = new(pki.MixDescriptor)
+		}
+		doc.Topology = append(doc.Topology, layer)
+	}
+	for i := 0; i < providers; i++ {
+		provider := &pki.MixDescriptor{Kaetzchen: make(map[string]map[string]interface{})}
+		if i < loopProviders {
+			provider.Kaetzchen[constants.LoopService] = map[string]interface{}{"endpoint": "+loop"}
+		}
+		doc.Providers = append(doc.Providers, provider)
+	}
+	return doc
+}
+
+func TestConfigDocumentPolicyLoopService(t *testing.T) {
+	assert := assert.New(t)
+
+	compliant := newTestPolicyDocument(3, 2, 2, 2)
+	partial := newTestPolicyDocument(3, 2, 2, 1)
+	none := newTestPolicyDocument(3, 2, 2, 0)
+
+	// rejecting is the default
+	p := NewConfigDocumentPolicy(nil)
+	action, err := p.CheckDocument(compliant)
+	assert.Equal(AcceptDocument, action)
+	assert.NoError(err)
+	action, err = p.CheckDocument(partial)
+	assert.Equal(RejectDocument, action)
+	assert.Error(err)
+
+	p = NewConfigDocumentPolicy(&config.DocumentPolicy{MissingLoopService: config.MissingLoopServiceIgnore})
+	action, err = p.CheckDocument(partial)
+	assert.Equal(AcceptDocument, action)
+	assert.NoError(err)
+	action, err = p.CheckDocument(none)
+	assert.Equal(AcceptDocumentWithoutDecoys, action)
+	assert.Error(err)
+
+	p = NewConfigDocumentPolicy(&config.DocumentPolicy{MissingLoopService: config.MissingLoopServiceDisableDecoys})
+	action, _ = p.CheckDocument(partial)
+	assert.Equal(AcceptDocumentWithoutDecoys, action)
+	action, _ = p.CheckDocument(compliant)
+	assert.Equal(AcceptDocument, action)
+}
+
+func TestConfigDocumentPolicyMinimums(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewConfigDocumentPolicy(&config.DocumentPolicy{
+		MinLayers:        3,
+		MinProviders:     2,
+		MinMixesPerLayer: 2,
+	})
+	action, err := p.CheckDocument(newTestPolicyDocument(3, 2, 2, 2))
+	assert.Equal(AcceptDocument, action)
+	assert.NoError(err)
+
+	for _, doc := range []*pki.Document{
+		newTestPolicyDocument(2, 2, 2, 2),
+		newTestPolicyDocument(3, 1, 2, 2),
+		newTestPolicyDocument(3, 2, 1, 1),
+	} {
+		action, err = p.CheckDocument(doc)
+		assert.Equal(RejectDocument, action)
+		assert.Error(err)
+	}
+}
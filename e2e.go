@@ -0,0 +1,159 @@
+// e2e.go - End to end encryption of messages to a link identity.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// SealedBlockLength is the length of a sealed message block, it fits
+	// in the payload of a single message.
+	SealedBlockLength = constants.UserForwardPayloadLength - 4
+
+	// MaxSealedPayloadLength is the maximum length of a payload which can
+	// be sealed in a single block.
+	MaxSealedPayloadLength = SealedBlockLength - sealedBlockHeaderLength - chacha20poly1305.Overhead - 4
+
+	// sealedBlockVersion is the version of the sealed block format, the
+	// first byte of every block.
+	sealedBlockVersion = 0
+
+	// sealedBlockHeaderLength is the length of the version byte and the
+	// ephemeral public key preceding the ciphertext.
+	sealedBlockHeaderLength = 1 + curve25519.PointSize
+
+	sealedBlockInfo = "meson-client e2e v0"
+)
+
+// ErrSealedBlockOpen is the error issued when a sealed block cannot be
+// decrypted with our link key.
+var ErrSealedBlockOpen = errors.New("e2e: failed to open sealed block")
+
+// ErrSealedBlockVersion is the error issued when a sealed block uses an
+// unsupported format version.
+var ErrSealedBlockVersion = errors.New("e2e: unsupported sealed block version")
+
+func sealedBlockKey(shared, ephemeralPub, recipientPub []byte) ([]byte, error) {
+	salt := make([]byte, 0, len(ephemeralPub)+len(recipientPub))
+	salt = append(salt, ephemeralPub...)
+	salt = append(salt, recipientPub...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, shared, salt, []byte(sealedBlockInfo))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// SealBlock encrypts payload to the recipient's link public key, the
+// resulting block is SealedBlockLength bytes long regardless of the payload
+// length.  The block is the format version byte, a fresh ephemeral X25519
+// public key and the ChaCha20-Poly1305 encryption of the length prefixed
+// and padded payload, under a key derived with HKDF-SHA256 from the
+// ephemeral shared secret and both public keys.  The header is
+// authenticated as additional data.
+//
+// The sender is not authenticated: the block is anonymous, and a recipient
+// can neither tell who sealed it nor tell apart two blocks from the same
+// sender.  Applications needing the identity of the sender must include
+// and authenticate it in the payload themselves.
+func SealBlock(recipient *ecdh.PublicKey, payload []byte) ([]byte, error) {
+	if len(payload) > MaxSealedPayloadLength {
+		return nil, fmt.Errorf("e2e: payload too large: %v", len(payload))
+	}
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, ephemeral); err != nil {
+		return nil, err
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	key, err := sealedBlockKey(shared, ephemeralPub, recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext := make([]byte, SealedBlockLength-sealedBlockHeaderLength-chacha20poly1305.Overhead)
+	binary.BigEndian.PutUint32(plaintext[:4], uint32(len(payload)))
+	copy(plaintext[4:], payload)
+
+	// Every block is sealed under a key derived from a fresh ephemeral key,
+	// so a key encrypts a single plaintext and the all zero nonce is never
+	// reused with the same key.
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	block := make([]byte, 0, SealedBlockLength)
+	block = append(block, sealedBlockVersion)
+	block = append(block, ephemeralPub...)
+	return aead.Seal(block, nonce, plaintext, block), nil
+}
+
+// OpenBlock decrypts a block sealed to our link key and returns the payload.
+// See SealBlock for the format of the block, which does not identify the
+// sender.
+func OpenBlock(linkKey *ecdh.PrivateKey, block []byte) ([]byte, error) {
+	if len(block) != SealedBlockLength {
+		return nil, fmt.Errorf("e2e: invalid sealed block length: %v", len(block))
+	}
+	if block[0] != sealedBlockVersion {
+		return nil, ErrSealedBlockVersion
+	}
+	header := block[:sealedBlockHeaderLength]
+	ephemeralPub := header[1:]
+	shared, err := curve25519.X25519(linkKey.Bytes(), ephemeralPub)
+	if err != nil {
+		return nil, ErrSealedBlockOpen
+	}
+	key, err := sealedBlockKey(shared, ephemeralPub, linkKey.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	plaintext, err := aead.Open(nil, nonce, block[sealedBlockHeaderLength:], header)
+	if err != nil {
+		return nil, ErrSealedBlockOpen
+	}
+	payloadLen := binary.BigEndian.Uint32(plaintext[:4])
+	if payloadLen > uint32(len(plaintext)-4) {
+		return nil, ErrSealedBlockOpen
+	}
+	return plaintext[4 : 4+payloadLen], nil
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSealedBlock(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	otherKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+
+	payload := []byte("hello spool")
+	block, err := SealBlock(linkKey.PublicKey(), payload)
+	require.NoError(err)
+	assert.Equal(SealedBlockLength, len(block))
+
+	opened, err := OpenBlock(linkKey, block)
+	require.NoError(err)
+	assert.Equal(payload, opened)
+
+	_, err = OpenBlock(otherKey, block)
+	assert.Equal(ErrSealedBlockOpen, err)
+
+	assert.Equal(byte(sealedBlockVersion), block[0])
+	block[0] = sealedBlockVersion + 1
+	_, err = OpenBlock(linkKey, block)
+	assert.Equal(ErrSealedBlockVersion, err)
+	block[0] = sealedBlockVersion
+
+	// the header is authenticated
+	block[1] ^= 0xff
+	_, err = OpenBlock(linkKey, block)
+	assert.Equal(ErrSealedBlockOpen, err)
+	block[1] ^= 0xff
+
+	block[len(block)-1] ^= 0xff
+	_, err = OpenBlock(linkKey, block)
+	assert.Equal(ErrSealedBlockOpen, err)
+
+	block, err = SealBlock(linkKey.PublicKey(), make([]byte, MaxSealedPayloadLength))
+	require.NoError(err)
+	opened, err = OpenBlock(linkKey, block)
+	require.NoError(err)
+	assert.Len(opened, MaxSealedPayloadLength)
+
+	_, err = SealBlock(linkKey.PublicKey(), make([]byte, MaxSealedPayloadLength+1))
+	assert.Error(err)
+}
+
+func TestSealedBlockFromPayload(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	block, err := SealBlock(linkKey.PublicKey(), []byte("hello"))
+	require.NoError(err)
+
+	// framed the way composeMessage does
+	payload := make([]byte, constants.UserForwardPayloadLength)
+	binary.BigEndian.PutUint32(payload[:4], uint32(len(block)))
+	copy(payload[4:], block)
+	unframed, err := sealedBlockFromPayload(payload)
+	require.NoError(err)
+	assert.Equal(block, unframed)
+
+	binary.BigEndian.PutUint32(payload[:4], 10)
+	_, err = sealedBlockFromPayload(payload)
+	assert.Error(err)
+}
+
+func TestReplayCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newReplayCache()
+	first := sha256.Sum256([]byte("first"))
+	assert.True(c.add(first))
+	assert.False(c.add(first))
+	for i := 0; i < replayCacheSize; i++ {
+		var digest [sha256.Size]byte
+		binary.BigEndian.PutUint32(digest[:], uint32(i))
+		assert.True(c.add(digest))
+	}
+	// first was evicted
+	assert.True(c.add(first))
+}
@@ -0,0 +1,240 @@
+// eventbus.go - Session event subscriptions.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"reflect"
+	"sync"
+
+	cConstants "github.com/katzenpost/client/constants"
+	"gopkg.in/eapache/channels.v1"
+)
+
+// DefaultSubscriptionBufferSize is the buffer size of a subscription when
+// none is given.
+const DefaultSubscriptionBufferSize = 64
+
+// OverflowPolicy selects what happens when the buffer of a subscription is
+// full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest buffered event to make room.
+	DropOldest OverflowPolicy = iota
+
+	// Block waits for the subscriber to read, which delays the delivery
+	// of events to every other subscription of the session: a subscriber
+	// which stops reading stalls them all until it is unsubscribed or the
+	// session is shut down.
+	Block
+
+	// Unbounded buffers every event in memory until it is read, so that
+	// none is lost and the other subscriptions are not delayed, at the
+	// cost of an unbounded memory use if the subscriber stops reading.
+	// The buffer size only applies to the channel the events are
+	// delivered on.
+	Unbounded
+)
+
+// EventFilter selects the events delivered to a subscription.  A nil
+// filter matches every event.
+type EventFilter struct {
+	// Types, if not empty, restricts the events to those of the same
+	// type as one of the listed events, eg: &MessageReplyEvent{}.
+	Types []Event
+
+	// MessageID, if set, restricts the events to those about the given
+	// message.
+	MessageID *[cConstants.MessageIDLength]byte
+}
+
+// eventMessageID returns the identifier of the message an event is about.
+func eventMessageID(e Event) *[cConstants.MessageIDLength]byte {
+	switch ev := e.(type) {
+	case *MessageReplyEvent:
+		return ev.MessageID
+	case *MessageSentEvent:
+		return ev.MessageID
+	case *MessageIDGarbageCollected:
+		return ev.MessageID
+	case *MessageAttemptEvent:
+		return ev.MessageID
+	case *MessageDeliveredEvent:
+		return ev.MessageID
+	case *MessageFailedEvent:
+		return ev.MessageID
+	}
+	return nil
+}
+
+// Matches returns true iff the event passes the filter.
+func (f *EventFilter) Matches(e Event) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Types) > 0 {
+		t := reflect.TypeOf(e)
+		found := false
+		for _, proto := range f.Types {
+			if reflect.TypeOf(proto) == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MessageID != nil {
+		id := eventMessageID(e)
+		if id == nil || *id != *f.MessageID {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscription is a stream of the session events matching a filter.
+type Subscription struct {
+	filter *EventFilter
+	policy OverflowPolicy
+	ch     chan Event
+	done   chan struct{}
+	once   sync.Once
+
+	// queue and stopped are the buffer of an Unbounded subscription and
+	// the channel closed once the events stopped being forwarded from it.
+	queue   *channels.InfiniteChannel
+	stopped chan struct{}
+}
+
+// Events returns the channel the subscribed events are delivered on, it
+// is closed by Unsubscribe.
+func (sub *Subscription) Events() <-chan Event {
+	return sub.ch
+}
+
+func (sub *Subscription) deliver(e Event, haltCh <-chan interface{}) {
+	if !sub.filter.Matches(e) {
+		return
+	}
+	if sub.policy == Unbounded {
+		sub.queue.In() <- e
+		return
+	}
+	if sub.policy == Block {
+		select {
+		case sub.ch <- e:
+		case <-sub.done:
+		case <-haltCh:
+		}
+		return
+	}
+	for {
+		select {
+		case sub.ch <- e:
+			return
+		default:
+		}
+		// Make room by dropping the oldest event.
+		select {
+		case <-sub.ch:
+		default:
+		}
+	}
+}
+
+// forward delivers the buffered events of an Unbounded subscription.
+func (sub *Subscription) forward(haltCh <-chan interface{}) {
+	defer close(sub.stopped)
+	for {
+		select {
+		case <-sub.done:
+			return
+		case <-haltCh:
+			return
+		case e, ok := <-sub.queue.Out():
+			if !ok {
+				return
+			}
+			select {
+			case sub.ch <- e.(Event):
+			case <-sub.done:
+				return
+			case <-haltCh:
+				return
+			}
+		}
+	}
+}
+
+// Subscribe returns a new subscription to the session events matching
+// filter, buffering up to bufferSize events and handling overflow
+// according to policy.
+func (s *Session) Subscribe(filter *EventFilter, bufferSize int, policy OverflowPolicy) *Subscription {
+	if bufferSize <= 0 {
+		bufferSize = DefaultSubscriptionBufferSize
+	}
+	sub := &Subscription{
+		filter: filter,
+		policy: policy,
+		ch:     make(chan Event, bufferSize),
+		done:   make(chan struct{}),
+	}
+	if policy == Unbounded {
+		sub.queue = channels.NewInfiniteChannel()
+		sub.stopped = make(chan struct{})
+		haltCh := s.HaltCh()
+		s.Go(func() {
+			sub.forward(haltCh)
+		})
+	}
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	s.subscriptions = append(s.subscriptions, sub)
+	return sub
+}
+
+// Unsubscribe removes the subscription and closes its channel.
+func (s *Session) Unsubscribe(sub *Subscription) {
+	sub.once.Do(func() {
+		// Unblock the delivery to this subscription, if any.
+		close(sub.done)
+
+		s.subscriptionsLock.Lock()
+		defer s.subscriptionsLock.Unlock()
+		for i, other := range s.subscriptions {
+			if other == sub {
+				s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+				break
+			}
+		}
+		if sub.queue != nil {
+			sub.queue.Close()
+			<-sub.stopped
+		}
+		close(sub.ch)
+	})
+}
+
+func (s *Session) publish(e Event) {
+	s.subscriptionsLock.RLock()
+	defer s.subscriptionsLock.RUnlock()
+	for _, sub := range s.subscriptions {
+		sub.deliver(e, s.HaltCh())
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	id1 := &[cConstants.MessageIDLength]byte{1}
+	id2 := &[cConstants.MessageIDLength]byte{2}
+	reply := &MessageReplyEvent{MessageID: id1}
+	sent := &MessageSentEvent{MessageID: id2}
+	conn := &ConnectionStatusEvent{IsConnected: true}
+
+	var f *EventFilter
+	assert.True(f.Matches(conn))
+
+	f = &EventFilter{Types: []Event{&MessageReplyEvent{}, &ConnectionStatusEvent{}}}
+	assert.True(f.Matches(reply))
+	assert.True(f.Matches(conn))
+	assert.False(f.Matches(sent))
+
+	f = &EventFilter{MessageID: id2}
+	assert.False(f.Matches(reply))
+	assert.True(f.Matches(sent))
+	assert.False(f.Matches(conn))
+}
+
+func TestSubscriptions(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	s := new(Session)
+	defer s.Halt()
+
+	all := s.Subscribe(nil, 2, DropOldest)
+	replies := s.Subscribe(&EventFilter{Types: []Event{&MessageReplyEvent{}}}, 0, DropOldest)
+
+	id := &[cConstants.MessageIDLength]byte{1}
+	events := []Event{
+		&ConnectionStatusEvent{IsConnected: true},
+		&MessageSentEvent{MessageID: id},
+		&MessageReplyEvent{MessageID: id},
+	}
+	for _, e := range events {
+		s.publish(e)
+	}
+
+	// the oldest event was dropped
+	require.Equal(2, len(all.Events()))
+	assert.Equal(events[1], <-all.Events())
+	assert.Equal(events[2], <-all.Events())
+	require.Equal(1, len(replies.Events()))
+	assert.Equal(events[2], <-replies.Events())
+
+	s.Unsubscribe(all)
+	_, ok := <-all.Events()
+	assert.False(ok)
+	s.Unsubscribe(all)
+
+	// Unsubscribe releases a blocked delivery
+	blocking := s.Subscribe(nil, 1, Block)
+	s.publish(events[0])
+	done := make(chan struct{})
+	go func() {
+		s.publish(events[1])
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("delivery did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Unsubscribe(blocking)
+	<-done
+}
+
+func TestUnboundedSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	s := new(Session)
+	defer s.Halt()
+
+	unbounded := s.Subscribe(nil, 1, Unbounded)
+	other := s.Subscribe(nil, 1, DropOldest)
+
+	// nothing is dropped and the other subscription is not delayed
+	n := 2 * DefaultSubscriptionBufferSize
+	for i := 0; i < n; i++ {
+		s.publish(&ConnectionStatusEvent{Err: fmt.Errorf("%d", i)})
+	}
+	assert.Equal(1, len(other.Events()))
+	for i := 0; i < n; i++ {
+		e := <-unbounded.Events()
+		assert.Equal(fmt.Sprintf("%d", i), e.(*ConnectionStatusEvent).Err.Error())
+	}
+
+	s.publish(&ConnectionStatusEvent{})
+	s.Unsubscribe(unbounded)
+	for range unbounded.Events() {
+	}
+	s.Unsubscribe(unbounded)
+}
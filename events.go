@@ -116,3 +116,222 @@ type NewDocumentEvent struct {
 func (e *NewDocumentEvent) String() string {
 	return fmt.Sprintf("PKI Document for epoch %d", e.Document.Epoch)
 }
+
+// ProviderChangedEvent is the event sent when the session failed over to
+// another Provider.
+type ProviderChangedEvent struct {
+	// OldProvider is the name of the Provider that was given up.
+	OldProvider string
+
+	// NewProvider is the name of the Provider now in use.
+	NewProvider string
+}
+
+// String returns a string representation of a ProviderChangedEvent.
+func (e *ProviderChangedEvent) String() string {
+	return fmt.Sprintf("ProviderChanged: %v -> %v", e.OldProvider, e.NewProvider)
+}
+
+// MessageAttemptEvent is the event sent each time a reliable message is
+// transmitted.
+type MessageAttemptEvent struct {
+	// MessageID is the local unique identifier for the message.
+	MessageID *[cConstants.MessageIDLength]byte
+
+	// Attempt is the transmission attempt number, starting at 1.
+	Attempt int
+
+	// SentAt contains the time the message was sent.
+	SentAt time.Time
+
+	// ReplyETA is the expected round trip time to receive a response.
+	ReplyETA time.Duration
+
+	// Err is the error encountered when sending the message if any.
+	Err error
+}
+
+// String returns a string representation of a MessageAttemptEvent.
+func (e *MessageAttemptEvent) String() string {
+	if e.Err != nil {
+		return fmt.Sprintf("MessageAttempt: %v #%d failed: %v", hex.EncodeToString(e.MessageID[:]), e.Attempt, e.Err)
+	}
+	return fmt.Sprintf("MessageAttempt: %v #%d", hex.EncodeToString(e.MessageID[:]), e.Attempt)
+}
+
+// MessageDeliveredEvent is the event sent when a reply to a reliable
+// message is received.
+type MessageDeliveredEvent struct {
+	// MessageID is the local unique identifier for the message.
+	MessageID *[cConstants.MessageIDLength]byte
+
+	// Attempts is the number of transmissions it took.
+	Attempts int
+}
+
+// String returns a string representation of a MessageDeliveredEvent.
+func (e *MessageDeliveredEvent) String() string {
+	return fmt.Sprintf("MessageDelivered: %v after %d attempts", hex.EncodeToString(e.MessageID[:]), e.Attempts)
+}
+
+// MessageFailedEvent is the event sent when a reliable message was given up
+// on.
+type MessageFailedEvent struct {
+	// MessageID is the local unique identifier for the message.
+	MessageID *[cConstants.MessageIDLength]byte
+
+	// Attempts is the number of transmissions made.
+	Attempts int
+
+	// Err is the reason the message was given up on.
+	Err error
+}
+
+// String returns a string representation of a MessageFailedEvent.
+func (e *MessageFailedEvent) String() string {
+	return fmt.Sprintf("MessageFailed: %v after %d attempts: %v", hex.EncodeToString(e.MessageID[:]), e.Attempts, e.Err)
+}
+
+// MessageReceivedEvent is the event sent when a message end to end
+// encrypted to our link key is received from our spool.  Such messages are
+// anonymous, see SealBlock.
+type MessageReceivedEvent struct {
+	// Payload is the sender supplied payload, which is not authenticated
+	// as coming from any particular sender.
+	Payload []byte
+}
+
+// String returns a string representation of a MessageReceivedEvent.
+func (e *MessageReceivedEvent) String() string {
+	return fmt.Sprintf("MessageReceived: %v bytes", len(e.Payload))
+}
+
+// LoopDecoyStatsEvent is the event sent with the loop decoy statistics of
+// an epoch, once every loop decoy sent in it returned or was lost.  As the
+// epoch is only known to be over once the PKI document of a later epoch is
+// current, no statistics are sent while the session has no such document,
+// and otherwise they are sent by the next garbage collection run.
+type LoopDecoyStatsEvent struct {
+	// Epoch is the epoch the loop decoys were sent in.
+	Epoch uint64
+
+	// Sent is the number of loop decoys sent.
+	Sent int
+
+	// Returned is the number of loop decoys which returned.
+	Returned int
+
+	// Lost is the number of loop decoys which did not return in time.
+	Lost int
+
+	// Loss is the fraction of the loop decoys which were lost.
+	Loss float64
+
+	// MeanLatency is the mean round trip time of the returned loop decoys.
+	MeanLatency time.Duration
+
+	// MaxLatency is the maximum round trip time of the returned loop
+	// decoys.
+	MaxLatency time.Duration
+
+	// ExceedsThreshold is true if the loss exceeds the configured
+	// LoopDecoyLossThreshold, and enough loop decoys were sent for it to
+	// be meaningful.
+	ExceedsThreshold bool
+}
+
+// String returns a string representation of a LoopDecoyStatsEvent.
+func (e *LoopDecoyStatsEvent) String() string {
+	return fmt.Sprintf("LoopDecoyStats: epoch %d lost %d of %d, mean latency %v", e.Epoch, e.Lost, e.Sent, e.MeanLatency)
+}
+
+// BandwidthBudgetEvent is the event sent when the traffic is throttled to
+// stay within the bandwidth budget, or no longer is.
+type BandwidthBudgetEvent struct {
+	// RemainingPackets is the number of packets left in the hourly
+	// budget, or -1 if there is no packet limit.
+	RemainingPackets int64
+
+	// RemainingBytes is the number of bytes left in the daily budget, or
+	// -1 if there is no byte limit.
+	RemainingBytes int64
+
+	// DecoyRateScale is the factor the decoy rates of the PKI document
+	// are scaled down by to fit the budget.
+	DecoyRateScale float64
+
+	// SendRateScale is the factor the LambdaP rate of the PKI document is
+	// scaled down by to fit the budget.
+	SendRateScale float64
+
+	// DecoysThrottled is true while decoys are suppressed to leave the
+	// rest of the budget to real sends.
+	DecoysThrottled bool
+
+	// SendsThrottled is true while queued messages are held because the
+	// budget is exhausted.
+	SendsThrottled bool
+}
+
+// String returns a string representation of a BandwidthBudgetEvent.
+func (e *BandwidthBudgetEvent) String() string {
+	return fmt.Sprintf("BandwidthBudget: %d packets, %d bytes left, decoys throttled: %v, sends throttled: %v",
+		e.RemainingPackets, e.RemainingBytes, e.DecoysThrottled, e.SendsThrottled)
+}
+
+// DocumentPolicyEvent is the event sent when the document policy does not
+// fully accept a new PKI document.
+type DocumentPolicyEvent struct {
+	// Epoch is the epoch of the PKI document.
+	Epoch uint64
+
+	// Action is the action taken by the document policy.
+	Action DocumentAction
+
+	// Err is the reason for the action.
+	Err error
+}
+
+// String returns a string representation of a DocumentPolicyEvent.
+func (e *DocumentPolicyEvent) String() string {
+	return fmt.Sprintf("DocumentPolicy: epoch %d: %v: %v", e.Epoch, e.Action, e.Err)
+}
+
+// SessionPausedEvent is the event sent when the session is paused.
+type SessionPausedEvent struct{}
+
+// String returns a string representation of a SessionPausedEvent.
+func (e *SessionPausedEvent) String() string {
+	return "SessionPaused"
+}
+
+// SessionResumedEvent is the event sent when a paused session is resumed.
+type SessionResumedEvent struct {
+	// PausedFor is how long the session was paused.
+	PausedFor time.Duration
+}
+
+// String returns a string representation of a SessionResumedEvent.
+func (e *SessionResumedEvent) String() string {
+	return fmt.Sprintf("SessionResumed: after %v", e.PausedFor)
+}
+
+// ClockSkewEvent is the event sent upon connecting to the Provider, with the
+// clock skew observed against it.
+type ClockSkewEvent struct {
+	// Skew is the difference between the Provider and the host clocks.
+	Skew time.Duration
+
+	// Corrected is true if the packets are composed with the host time
+	// corrected by the skew.
+	Corrected bool
+
+	// Unsafe is true if the skew exceeds the configured MaxClockSkew, in
+	// which case nothing is sent until the next connection.
+	Unsafe bool
+}
+
+// String returns a string representation of a ClockSkewEvent.
+func (e *ClockSkewEvent) String() string {
+	return fmt.Sprintf("ClockSkew: %v, corrected: %v, unsafe: %v", e.Skew, e.Corrected, e.Unsafe)
+}
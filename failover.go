@@ -0,0 +1,198 @@
+// failover.go - Provider failover.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/hashcloak/Meson-client/config"
+)
+
+// failoverState tracks the health of our Provider, it is owned by the
+// session worker.
+type failoverState struct {
+	generation      uint64
+	missingEpochs   int
+	connectFailures int
+	lastEpoch       uint64
+}
+
+func newFailoverState() *failoverState {
+	return new(failoverState)
+}
+
+// reset clears the counters when the minclient instance changed.
+func (f *failoverState) reset(generation uint64) {
+	if f.generation != generation {
+		f.generation = generation
+		f.missingEpochs = 0
+		f.connectFailures = 0
+		f.lastEpoch = 0
+	}
+}
+
+func (s *Session) failoverEnabled() bool {
+	return s.cfg.Failover != nil && s.cfg.Failover.Enable
+}
+
+func (s *Session) onFailoverConnStatus(f *failoverState, op opConnStatusChanged) {
+	if !s.failoverEnabled() {
+		return
+	}
+	f.reset(op.generation)
+	if op.isConnected {
+		f.connectFailures = 0
+		return
+	}
+	if op.err == nil {
+		return
+	}
+	f.connectFailures++
+	if f.connectFailures >= s.cfg.Failover.MaxConnectFailures {
+		s.startFailover(fmt.Sprintf("%d consecutive connection failures", f.connectFailures))
+	}
+}
+
+func (s *Session) onFailoverDocument(f *failoverState, op opNewDocument) {
+	if !s.failoverEnabled() {
+		return
+	}
+	f.reset(op.generation)
+	if op.doc.Epoch == f.lastEpoch {
+		return
+	}
+	f.lastEpoch = op.doc.Epoch
+	provider := s.Account().Provider
+	if _, err := op.doc.GetProvider(provider); err == nil {
+		f.missingEpochs = 0
+		return
+	}
+	f.missingEpochs++
+	s.log.Warningf("Provider %v is missing from the PKI document for epoch %v", provider, op.doc.Epoch)
+	if f.missingEpochs >= s.cfg.Failover.MaxMissingEpochs {
+		s.startFailover(fmt.Sprintf("Provider missing from the PKI document for %d epochs", f.missingEpochs))
+	}
+}
+
+// startFailover fails over to another Provider in the background unless a
+// failover is already in progress.
+func (s *Session) startFailover(reason string) {
+	if s.isPaused() {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&s.failingOver, 0, 1) {
+		return
+	}
+	s.log.Warningf("Failing over to another Provider: %v", reason)
+	s.Go(func() {
+		defer atomic.StoreUint32(&s.failingOver, 0)
+		if err := s.failover(); err != nil {
+			s.log.Errorf("Provider failover failed: %v", err)
+		}
+	})
+}
+
+// failoverRegistration returns a copy of the registration configuration
+// whose selection policy excludes the named Provider.
+func failoverRegistration(r *config.Registration, provider string) *config.Registration {
+	registration := new(config.Registration)
+	if r != nil {
+		*registration = *r
+	}
+	selection := new(config.ProviderSelection)
+	if registration.Selection != nil {
+		*selection = *registration.Selection
+	}
+	selection.Deny = append([]string{provider}, selection.Deny...)
+	registration.Selection = selection
+	return registration
+}
+
+// failover registers the session identity with another Provider and moves
+// the session over to it.  Pending egress messages are kept.
+func (s *Session) failover() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.HaltCh():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	oldAccount := s.Account()
+	cfg := *s.cfg
+	cfg.Registration = failoverRegistration(s.cfg.Registration, oldAccount.Provider)
+	_, err := Register(ctx, &cfg, &RegisterOptions{
+		LinkKey:   s.linkKey,
+		User:      oldAccount.User,
+		PKIClient: s.pkiClient,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.pauseLock.Lock()
+	if s.isPaused() {
+		s.pauseLock.Unlock()
+		return ErrPaused
+	}
+	old, err := s.replaceMinclient(cfg.Account)
+	s.pauseLock.Unlock()
+	if err != nil {
+		return err
+	}
+	old.Shutdown()
+	select {
+	case <-s.HaltCh():
+		// Shutdown may have missed the new instance.
+		s.currentMinclient().Shutdown()
+		return ctx.Err()
+	default:
+	}
+	s.log.Noticef("Failed over from Provider %v to %v", oldAccount.Provider, cfg.Account.Provider)
+
+	if err := s.updateKeystore(cfg.Account); err != nil {
+		s.log.Errorf("Failed to update the keystore: %v", err)
+	}
+	s.eventCh.In() <- &ProviderChangedEvent{
+		OldProvider: oldAccount.Provider,
+		NewProvider: cfg.Account.Provider,
+	}
+	return nil
+}
+
+// updateKeystore records the new account in the keystore if the keystore
+// holds the identity of this session.
+func (s *Session) updateKeystore(account *config.Account) error {
+	if s.cfg.Keystore == nil {
+		return nil
+	}
+	id, err := LoadIdentity(s.cfg.Keystore.File, s.cfg.Keystore.Passphrase)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(id.LinkKey.Bytes(), s.linkKey.Bytes()) {
+		return nil
+	}
+	id.Account = account
+	return SaveIdentity(s.cfg.Keystore.File, s.cfg.Keystore.Passphrase, id)
+}
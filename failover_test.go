@@ -0,0 +1,32 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailoverRegistration(t *testing.T) {
+	assert := assert.New(t)
+
+	r := failoverRegistration(nil, "provider1")
+	assert.False(r.PermitsProvider("provider1"))
+	assert.True(r.PermitsProvider("provider2"))
+
+	orig := &config.Registration{
+		Address: "127.0.0.1:36968",
+		Selection: &config.ProviderSelection{
+			Deny: []string{"provider3"},
+		},
+	}
+	r = failoverRegistration(orig, "provider1")
+	assert.Equal(orig.Address, r.Address)
+	assert.False(r.PermitsProvider("provider1"))
+	assert.False(r.PermitsProvider("provider3"))
+	assert.True(r.PermitsProvider("provider2"))
+
+	// The original policy is left untouched.
+	assert.Equal([]string{"provider3"}, orig.Selection.Deny)
+	assert.True(orig.PermitsProvider("provider1"))
+}
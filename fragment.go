@@ -0,0 +1,390 @@
+// fragment.go - Fragmentation and reassembly of large messages.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	// FragmentHeaderLength is the length of the header prepended to
+	// each fragment.
+	FragmentHeaderLength = 4 + cConstants.MessageIDLength + 2 + 2 + 4 + sha256.Size
+
+	// FragmentPayloadLength is the maximum number of message bytes carried
+	// by a fragment, so that a fragment fits in a single message.
+	FragmentPayloadLength = constants.UserForwardPayloadLength - 4 - FragmentHeaderLength
+
+	// MaxFragments is the maximum number of fragments of a message.
+	MaxFragments = math.MaxUint16
+
+	// MaxQueuedFragments is the maximum number of fragments of a message
+	// sent with SendLargeMessage, as all of them are queued at once.
+	MaxQueuedFragments = cConstants.MaxEgressQueueSize
+
+	// DefaultReassemblyTimeout is the default duration after which a
+	// partially received message is discarded.
+	DefaultReassemblyTimeout = 10 * time.Minute
+
+	// maxPartialMessages is the maximum number of partially received
+	// messages kept by a Reassembler, the oldest is discarded first.
+	maxPartialMessages = 64
+)
+
+var fragmentMagic = []byte("MFR0")
+
+// ErrFragmentIntegrity is the error issued when a reassembled message does
+// not match the digest carried by its fragments.
+var ErrFragmentIntegrity = errors.New("fragment: reassembled message digest mismatch")
+
+// ErrTooManyFragments is the error issued when a message sent with
+// SendLargeMessage needs more than MaxQueuedFragments fragments.
+var ErrTooManyFragments = fmt.Errorf("fragment: message needs more than %d fragments", MaxQueuedFragments)
+
+// ErrNotFragment is the error issued when a payload is not a fragment.
+var ErrNotFragment = errors.New("fragment: payload is not a fragment")
+
+type fragmentHeader struct {
+	id     [cConstants.MessageIDLength]byte
+	total  uint16
+	index  uint16
+	length uint32
+	digest [sha256.Size]byte
+}
+
+func (h *fragmentHeader) encode(data []byte) []byte {
+	b := make([]byte, FragmentHeaderLength, FragmentHeaderLength+len(data))
+	off := copy(b, fragmentMagic)
+	off += copy(b[off:], h.id[:])
+	binary.BigEndian.PutUint16(b[off:], h.total)
+	binary.BigEndian.PutUint16(b[off+2:], h.index)
+	binary.BigEndian.PutUint32(b[off+4:], h.length)
+	copy(b[off+8:], h.digest[:])
+	return append(b, data...)
+}
+
+func decodeFragment(b []byte) (*fragmentHeader, []byte, error) {
+	if !IsFragment(b) {
+		return nil, nil, ErrNotFragment
+	}
+	h := new(fragmentHeader)
+	off := len(fragmentMagic)
+	off += copy(h.id[:], b[off:])
+	h.total = binary.BigEndian.Uint16(b[off:])
+	h.index = binary.BigEndian.Uint16(b[off+2:])
+	h.length = binary.BigEndian.Uint32(b[off+4:])
+	copy(h.digest[:], b[off+8:])
+	if h.total == 0 || h.index >= h.total {
+		return nil, nil, fmt.Errorf("fragment: invalid index %d of %d", h.index, h.total)
+	}
+	if h.length > FragmentPayloadLength || int(h.length) > len(b)-FragmentHeaderLength {
+		return nil, nil, fmt.Errorf("fragment: invalid length %d", h.length)
+	}
+	return h, b[FragmentHeaderLength : FragmentHeaderLength+int(h.length)], nil
+}
+
+// IsFragment returns true if the payload starts with a fragment header.
+func IsFragment(payload []byte) bool {
+	return len(payload) >= FragmentHeaderLength && bytes.Equal(payload[:len(fragmentMagic)], fragmentMagic)
+}
+
+// FragmentMessage splits message into fragments which each fit in a single
+// message.  The fragments carry id and the digest of the whole message.
+func FragmentMessage(id *[cConstants.MessageIDLength]byte, message []byte) ([][]byte, error) {
+	total := (len(message) + FragmentPayloadLength - 1) / FragmentPayloadLength
+	if total == 0 {
+		total = 1
+	}
+	if total > MaxFragments {
+		return nil, fmt.Errorf("fragment: message too large: %v", len(message))
+	}
+	h := &fragmentHeader{
+		id:     *id,
+		total:  uint16(total),
+		digest: sha256.Sum256(message),
+	}
+	fragments := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		start := i * FragmentPayloadLength
+		end := start + FragmentPayloadLength
+		if end > len(message) {
+			end = len(message)
+		}
+		h.index = uint16(i)
+		h.length = uint32(end - start)
+		fragments = append(fragments, h.encode(message[start:end]))
+	}
+	return fragments, nil
+}
+
+type partialMessage struct {
+	total     uint16
+	digest    [sha256.Size]byte
+	fragments map[uint16][]byte
+	firstSeen time.Time
+}
+
+// Reassembler reassembles messages from their fragments, which may arrive
+// in any order and more than once.
+type Reassembler struct {
+	sync.Mutex
+
+	clock    clock.Clock
+	timeout  time.Duration
+	partials map[[cConstants.MessageIDLength]byte]*partialMessage
+}
+
+// NewReassembler returns a Reassembler which discards partially received
+// messages after timeout.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return NewReassemblerWithClock(timeout, clock.Real)
+}
+
+// NewReassemblerWithClock is like NewReassembler but the timeout is
+// measured with the given clock.
+func NewReassemblerWithClock(timeout time.Duration, clk clock.Clock) *Reassembler {
+	if timeout <= 0 {
+		timeout = DefaultReassemblyTimeout
+	}
+	return &Reassembler{
+		clock:    clk,
+		timeout:  timeout,
+		partials: make(map[[cConstants.MessageIDLength]byte]*partialMessage),
+	}
+}
+
+// Add adds a fragment and returns the message identifier along with the
+// reassembled message once all of its fragments were received, otherwise
+// the returned message is nil.
+func (r *Reassembler) Add(fragment []byte) (*[cConstants.MessageIDLength]byte, []byte, error) {
+	h, data, err := decodeFragment(fragment)
+	if err != nil {
+		return nil, nil, err
+	}
+	id := h.id
+
+	r.Lock()
+	defer r.Unlock()
+	now := r.clock.Now()
+	r.prune(now)
+	p, ok := r.partials[id]
+	if !ok {
+		if len(r.partials) >= maxPartialMessages {
+			r.evictOldest()
+		}
+		p = &partialMessage{
+			total:     h.total,
+			digest:    h.digest,
+			fragments: make(map[uint16][]byte),
+			firstSeen: now,
+		}
+		r.partials[id] = p
+	}
+	if p.total != h.total || p.digest != h.digest {
+		delete(r.partials, id)
+		return &id, nil, fmt.Errorf("fragment: inconsistent fragment %d of message %x", h.index, id)
+	}
+	if _, ok := p.fragments[h.index]; !ok {
+		p.fragments[h.index] = append([]byte{}, data...)
+	}
+	if len(p.fragments) < int(p.total) {
+		return &id, nil, nil
+	}
+
+	delete(r.partials, id)
+	message := make([]byte, 0, int(p.total)*FragmentPayloadLength)
+	for i := uint16(0); i < p.total; i++ {
+		message = append(message, p.fragments[i]...)
+	}
+	if sha256.Sum256(message) != p.digest {
+		return &id, nil, ErrFragmentIntegrity
+	}
+	return &id, message, nil
+}
+
+// Prune discards the partially received messages which timed out and
+// returns how many were discarded.
+func (r *Reassembler) Prune() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.prune(r.clock.Now())
+}
+
+func (r *Reassembler) prune(now time.Time) int {
+	n := 0
+	for id, p := range r.partials {
+		if now.Sub(p.firstSeen) > r.timeout {
+			delete(r.partials, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Reassembler) evictOldest() {
+	var oldestID [cConstants.MessageIDLength]byte
+	var oldest *partialMessage
+	for id, p := range r.partials {
+		if oldest == nil || p.firstSeen.Before(oldest.firstSeen) {
+			oldestID, oldest = id, p
+		}
+	}
+	delete(r.partials, oldestID)
+}
+
+// LargeMessage is the handle of a message sent in fragments by
+// SendLargeMessage.
+type LargeMessage struct {
+	// ID is the identifier of the fragment set, which the recipient
+	// reassembles the message by and which replies made of fragments carry
+	// as the MessageID of their MessageReplyEvent.
+	ID *[cConstants.MessageIDLength]byte
+
+	// MessageIDs are the identifiers of the messages carrying the
+	// fragments, in order, as used by MessageStatus, CancelMessage and the
+	// events of each message.
+	MessageIDs []*[cConstants.MessageIDLength]byte
+}
+
+// SendLargeMessage asynchronously sends a message of any size up to
+// MaxQueuedFragments fragments, otherwise ErrTooManyFragments is returned.
+// The fragments are queued at once, either all of them or none, so the
+// egress queue must have room for all of them.  The recipient reassembles
+// the message with a Reassembler, and replies made of fragments carrying
+// the ID of the returned handle are reassembled into a single
+// MessageReplyEvent.
+func (s *Session) SendLargeMessage(recipient, provider string, message []byte) (*LargeMessage, error) {
+	id := new([cConstants.MessageIDLength]byte)
+	_, err := io.ReadFull(rand.Reader, id[:])
+	if err != nil {
+		return nil, err
+	}
+	fragments, err := FragmentMessage(id, message)
+	if err != nil {
+		return nil, err
+	}
+	if len(fragments) > MaxQueuedFragments {
+		return nil, ErrTooManyFragments
+	}
+	msgs := make([]*Message, 0, len(fragments))
+	items := make([]Item, 0, len(fragments))
+	for _, fragment := range fragments {
+		msg, err := s.composeMessage(recipient, provider, fragment, false)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+		items = append(items, msg)
+	}
+	for _, msg := range msgs {
+		s.statuses.queued(msg.ID)
+	}
+	if err = s.pushItems(items); err != nil {
+		for _, msg := range msgs {
+			s.statuses.remove(msg.ID)
+		}
+		return nil, fmt.Errorf("failed to queue %d fragments: %v", len(fragments), err)
+	}
+	m := &LargeMessage{
+		ID:         id,
+		MessageIDs: make([]*[cConstants.MessageIDLength]byte, 0, len(msgs)),
+	}
+	for _, msg := range msgs {
+		m.MessageIDs = append(m.MessageIDs, msg.ID)
+	}
+	return m, nil
+}
+
+// LargeMessageStatus returns the current status of each fragment of a
+// message sent by SendLargeMessage, in order.
+func (s *Session) LargeMessageStatus(m *LargeMessage) ([]*MessageStatus, error) {
+	statuses := make([]*MessageStatus, 0, len(m.MessageIDs))
+	for _, id := range m.MessageIDs {
+		status, err := s.MessageStatus(id)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CancelLargeMessage removes the fragments of a message sent by
+// SendLargeMessage which are still queued.  The fragments already sent
+// cannot be recalled, the recipient discards them once its reassembly
+// times out.  ErrMessageAlreadySent is returned if every fragment was
+// already sent.
+func (s *Session) CancelLargeMessage(m *LargeMessage) error {
+	cancelled := 0
+	for _, id := range m.MessageIDs {
+		switch err := s.CancelMessage(id); err {
+		case nil:
+			cancelled++
+		case ErrMessageAlreadySent:
+		default:
+			return err
+		}
+	}
+	if cancelled == 0 {
+		return ErrMessageAlreadySent
+	}
+	return nil
+}
+
+// replyFragment returns the fragment carried by a SURB reply payload,
+// which is framed with the length prefix stripped by ValidateReply, the
+// same way composeMessage frames the fragments sent.
+func replyFragment(reply []byte) ([]byte, bool) {
+	if len(reply) < 4 {
+		return nil, false
+	}
+	fragment, err := ValidateReply(reply)
+	if err != nil || !IsFragment(fragment) {
+		return nil, false
+	}
+	return fragment, true
+}
+
+// onFragmentReply handles a SURB reply which is a fragment, emitting a
+// MessageReplyEvent once the reply is reassembled.
+func (s *Session) onFragmentReply(payload []byte) {
+	id, message, err := s.replyReassembler.Add(payload)
+	if err != nil {
+		s.log.Warningf("Discarding reply fragment: %v", err)
+		return
+	}
+	if message == nil {
+		return
+	}
+	s.eventCh.In() <- &MessageReplyEvent{
+		MessageID: id,
+		Payload:   message,
+	}
+}
@@ -0,0 +1,214 @@
+package client
+
+import (
+	"io"
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+	"gopkg.in/op/go-logging.v1"
+)
+
+func TestFragmentReassemble(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	id := new([cConstants.MessageIDLength]byte)
+	_, err := io.ReadFull(rand.Reader, id[:])
+	require.NoError(err)
+	message := make([]byte, 3*FragmentPayloadLength+42)
+	_, err = io.ReadFull(rand.Reader, message)
+	require.NoError(err)
+
+	fragments, err := FragmentMessage(id, message)
+	require.NoError(err)
+	require.Equal(4, len(fragments))
+	for _, fragment := range fragments {
+		assert.True(IsFragment(fragment))
+		// fits in a message built by composeMessage
+		assert.True(len(fragment) <= constants.UserForwardPayloadLength-4)
+	}
+
+	// out of order and duplicated
+	r := NewReassembler(DefaultReassemblyTimeout)
+	order := mrand.Perm(len(fragments))
+	for i, j := range order {
+		gotID, reassembled, err := r.Add(fragments[j])
+		require.NoError(err)
+		assert.Equal(id, gotID)
+		if i < len(order)-1 {
+			assert.Nil(reassembled)
+			_, reassembled, err = r.Add(fragments[j])
+			require.NoError(err)
+			assert.Nil(reassembled)
+		} else {
+			assert.Equal(message, reassembled)
+		}
+	}
+	assert.Equal(0, len(r.partials))
+}
+
+func TestFragmentIntegrity(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	id := new([cConstants.MessageIDLength]byte)
+	message := make([]byte, FragmentPayloadLength+1)
+	fragments, err := FragmentMessage(id, message)
+	require.NoError(err)
+	require.Equal(2, len(fragments))
+
+	fragments[1][FragmentHeaderLength] ^= 0xff
+	r := NewReassembler(DefaultReassemblyTimeout)
+	_, _, err = r.Add(fragments[0])
+	require.NoError(err)
+	_, _, err = r.Add(fragments[1])
+	assert.Equal(ErrFragmentIntegrity, err)
+
+	_, _, err = r.Add([]byte("not a fragment"))
+	assert.Equal(ErrNotFragment, err)
+}
+
+func TestReassemblerTimeout(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	id := new([cConstants.MessageIDLength]byte)
+	fragments, err := FragmentMessage(id, make([]byte, 2*FragmentPayloadLength))
+	require.NoError(err)
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	r := NewReassemblerWithClock(DefaultReassemblyTimeout, clk)
+	_, _, err = r.Add(fragments[0])
+	require.NoError(err)
+	clk.Advance(DefaultReassemblyTimeout)
+	assert.Equal(0, r.Prune())
+	clk.Advance(time.Second)
+	assert.Equal(1, r.Prune())
+	assert.Equal(0, len(r.partials))
+}
+
+func TestSendLargeMessageQueuesAllOrNone(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	q := new(Queue)
+	s := &Session{
+		log:         logging.MustGetLogger("test"),
+		egressQueue: q,
+		statuses:    newStatusHistory(clock.Real),
+	}
+	_, err := s.SendLargeMessage("recipient", "provider", make([]byte, MaxQueuedFragments*FragmentPayloadLength+1))
+	assert.Equal(ErrTooManyFragments, err)
+	_, err = q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+
+	// there is no room for the third fragment
+	for i := 0; i < cConstants.MaxEgressQueueSize-2; i++ {
+		require.NoError(q.Push(newTestMessage(0)))
+	}
+	_, err = s.SendLargeMessage("recipient", "provider", make([]byte, 3*FragmentPayloadLength))
+	assert.Error(err)
+	for i := 0; i < cConstants.MaxEgressQueueSize-2; i++ {
+		_, err = q.Pop()
+		require.NoError(err)
+	}
+	_, err = q.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+
+	m, err := s.SendLargeMessage("recipient", "provider", make([]byte, 3*FragmentPayloadLength))
+	require.NoError(err)
+	require.Len(m.MessageIDs, 3)
+	for i := 0; i < 3; i++ {
+		item, err := q.Pop()
+		require.NoError(err)
+		assert.Equal(m.MessageIDs[i], item.(*Message).ID)
+		assert.True(IsFragment(item.(*Message).Payload[4:]))
+	}
+}
+
+func TestFragmentReplyRoundTrip(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	q := new(Queue)
+	sender := &Session{
+		log:         logging.MustGetLogger("test"),
+		egressQueue: q,
+		statuses:    newStatusHistory(clock.Real),
+	}
+	message := make([]byte, 2*FragmentPayloadLength+42)
+	_, err := io.ReadFull(rand.Reader, message)
+	require.NoError(err)
+	m, err := sender.SendLargeMessage("recipient", "provider", message)
+	require.NoError(err)
+
+	// the fragments are replied framed the way they were sent
+	s := &Session{
+		log:              logging.MustGetLogger("test"),
+		eventCh:          channels.NewInfiniteChannel(),
+		replyReassembler: NewReassembler(DefaultReassemblyTimeout),
+	}
+	for range m.MessageIDs {
+		item, err := q.Pop()
+		require.NoError(err)
+		reply := item.(*Message).Payload
+		assert.False(IsFragment(reply))
+		fragment, ok := replyFragment(reply)
+		require.True(ok)
+		s.onFragmentReply(fragment)
+	}
+	event := (<-s.eventCh.Out()).(*MessageReplyEvent)
+	assert.Equal(m.ID, event.MessageID)
+	assert.Equal(message, event.Payload)
+
+	_, ok := replyFragment([]byte{0, 0})
+	assert.False(ok)
+	_, ok = replyFragment(make([]byte, constants.UserForwardPayloadLength))
+	assert.False(ok)
+}
+
+func TestLargeMessageHandle(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	q := new(Queue)
+	s := &Session{
+		log:         logging.MustGetLogger("test"),
+		egressQueue: q,
+		statuses:    newStatusHistory(clock.Real),
+	}
+	m, err := s.SendLargeMessage("recipient", "provider", make([]byte, 3*FragmentPayloadLength))
+	require.NoError(err)
+	statuses, err := s.LargeMessageStatus(m)
+	require.NoError(err)
+	require.Len(statuses, 3)
+	for i, status := range statuses {
+		assert.Equal(m.MessageIDs[i], status.MessageID)
+		assert.Equal(MessageQueued, status.State)
+	}
+
+	// the first fragment is sent, the others are cancelled
+	item, err := q.Pop()
+	require.NoError(err)
+	s.statuses.sent(item.(*Message), time.Second, nil)
+	require.NoError(s.CancelLargeMessage(m))
+	_, err = q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+	statuses, err = s.LargeMessageStatus(m)
+	require.NoError(err)
+	assert.Equal(MessageSent, statuses[0].State)
+	assert.Equal(MessageCancelled, statuses[1].State)
+	assert.Equal(MessageCancelled, statuses[2].State)
+	assert.Equal(ErrMessageAlreadySent, s.CancelLargeMessage(m))
+
+	_, err = s.LargeMessageStatus(&LargeMessage{MessageIDs: []*[cConstants.MessageIDLength]byte{m.ID}})
+	assert.Equal(ErrMessageStatusNotFound, err)
+}
@@ -6,6 +6,7 @@ require (
 	github.com/BurntSushi/toml v0.4.1
 	github.com/OneOfOne/xxhash v1.2.5 // indirect
 	github.com/cosmos/iavl v0.15.3
+	github.com/fxamacker/cbor/v2 v2.2.0
 	github.com/hashcloak/katzenmint-pki v0.0.0-20220116114902-61f41bc1abac
 	github.com/katzenpost/client v0.0.3
 	github.com/katzenpost/core v0.0.12
@@ -15,6 +16,7 @@ require (
 	github.com/stretchr/testify v1.7.0
 	github.com/tendermint/tendermint v0.34.10
 	github.com/tendermint/tm-db v0.6.4
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
 	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
 	golang.org/x/text v0.3.6
 	gopkg.in/eapache/channels.v1 v1.1.0
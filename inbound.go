@@ -0,0 +1,153 @@
+// inbound.go - Inbound spool message handling.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
+const (
+	// inboundQueueSize is the number of received messages buffered for
+	// ReceiveMessage, the oldest ones are dropped when it is full.
+	inboundQueueSize = 64
+
+	// replayCacheSize is the number of recently received blocks
+	// remembered to discard duplicates.
+	replayCacheSize = 1024
+)
+
+// ErrSessionShutdown is the error issued when the session is shutting down.
+var ErrSessionShutdown = errors.New("session is shutting down")
+
+// replayCache is a bounded set of the digests of recently received blocks.
+type replayCache struct {
+	sync.Mutex
+	seen  map[[sha256.Size]byte]struct{}
+	order [][sha256.Size]byte
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{
+		seen: make(map[[sha256.Size]byte]struct{}),
+	}
+}
+
+// add returns false if the digest was already seen.
+func (c *replayCache) add(digest [sha256.Size]byte) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.seen[digest]; ok {
+		return false
+	}
+	if len(c.order) >= replayCacheSize {
+		delete(c.seen, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.seen[digest] = struct{}{}
+	c.order = append(c.order, digest)
+	return true
+}
+
+// sealedBlockFromPayload strips the length prefix added by composeMessage.
+func sealedBlockFromPayload(payload []byte) ([]byte, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("message too short")
+	}
+	blockLen := binary.BigEndian.Uint32(payload[:4])
+	if blockLen != SealedBlockLength || len(payload)-4 < SealedBlockLength {
+		return nil, fmt.Errorf("invalid sealed block length: %v", blockLen)
+	}
+	return payload[4 : 4+SealedBlockLength], nil
+}
+
+// SendSealedMessage asynchronously sends message end to end encrypted to
+// the link key of a client, which receives it from its spool.
+func (s *Session) SendSealedMessage(recipient, provider string, recipientKey *ecdh.PublicKey, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	block, err := SealBlock(recipientKey, message)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := s.composeMessage(recipient, provider, block, false)
+	if err != nil {
+		return nil, err
+	}
+	msg.WithSURB = false
+	err = s.enqueue(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg.ID, nil
+}
+
+func (s *Session) handleInbound(ciphertextBlock []byte) {
+	block, err := sealedBlockFromPayload(ciphertextBlock)
+	if err != nil {
+		s.log.Debugf("Discarding inbound message: %v", err)
+		return
+	}
+	payload, err := OpenBlock(s.linkKey, block)
+	if err != nil {
+		s.log.Debugf("Discarding inbound message: %v", err)
+		return
+	}
+	if !s.inboundReplay.add(sha256.Sum256(block)) {
+		s.log.Debugf("Discarding duplicate inbound message")
+		return
+	}
+	s.eventCh.In() <- &MessageReceivedEvent{
+		Payload: payload,
+	}
+	s.enqueueInbound(payload)
+}
+
+func (s *Session) enqueueInbound(payload []byte) {
+	for {
+		select {
+		case s.inboundCh <- payload:
+			return
+		default:
+		}
+		// Make room by dropping the oldest message.
+		select {
+		case <-s.inboundCh:
+			s.log.Warning("Inbound queue full, dropping oldest message")
+		default:
+		}
+	}
+}
+
+// ReceiveMessage blocks until a message is received from our spool or the
+// context is done, and returns its payload.  Messages are also delivered as
+// MessageReceivedEvent on EventSink.
+func (s *Session) ReceiveMessage(ctx context.Context) ([]byte, error) {
+	select {
+	case payload := <-s.inboundCh:
+		return payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.HaltCh():
+		return nil, ErrSessionShutdown
+	}
+}
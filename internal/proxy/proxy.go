@@ -123,6 +123,9 @@ func (cfg *Config) FixupAndValidate() error {
 // ToDialContext returns a function matching Dialer.DialContext() that will
 // utilize the configured proxy or nil iff no proxy is configured.
 func (cfg *Config) ToDialContext(tag string) DialContextFn {
+	if cfg == nil {
+		return nil
+	}
 	switch cfg.Type {
 	case typeNone:
 		return nil
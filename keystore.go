@@ -0,0 +1,202 @@
+// keystore.go - Persistent client identity keystore.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	keystoreVersion   = 0
+	keystoreSaltSize  = 16
+	keystoreNonceSize = 24
+	keystoreKeySize   = 32
+
+	// Argon2id parameters used to derive the keystore encryption key.
+	keystoreKDFTime    = 3
+	keystoreKDFMemory  = 64 * 1024
+	keystoreKDFThreads = 4
+)
+
+// ErrKeystoreNotFound is the error returned when the keystore file does not exist.
+var ErrKeystoreNotFound = errors.New("keystore: not found")
+
+// ErrKeystoreDecrypt is the error returned when the keystore cannot be
+// decrypted, most likely due to a wrong passphrase.
+var ErrKeystoreDecrypt = errors.New("keystore: decryption failed, wrong passphrase?")
+
+// ErrKeystoreEmptyPassphrase is the error returned when the keystore is
+// used without a passphrase.
+var ErrKeystoreEmptyPassphrase = errors.New("keystore: empty passphrase")
+
+// Identity is the persistent identity of a client: the link key and the
+// account it is registered with.
+type Identity struct {
+	// LinkKey is the client's link authentication private key.
+	LinkKey *ecdh.PrivateKey
+
+	// Account is the Provider account the link key is registered with.
+	Account *config.Account
+}
+
+type keystoreFile struct {
+	Version    int
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+type keystoreIdentity struct {
+	LinkKey        []byte
+	User           string
+	Provider       string
+	ProviderKeyPin []byte
+}
+
+func keystoreKey(passphrase string, salt []byte) *[keystoreKeySize]byte {
+	var key [keystoreKeySize]byte
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, keystoreKDFTime, keystoreKDFMemory, keystoreKDFThreads, keystoreKeySize))
+	return &key
+}
+
+// SaveIdentity encrypts the identity with the passphrase, which must not be
+// empty, and atomically writes it to the keystore file.
+func SaveIdentity(fileName, passphrase string, id *Identity) error {
+	if passphrase == "" {
+		return ErrKeystoreEmptyPassphrase
+	}
+	if id.LinkKey == nil || id.Account == nil {
+		return errors.New("keystore: incomplete identity")
+	}
+	ki := &keystoreIdentity{
+		LinkKey:  id.LinkKey.Bytes(),
+		User:     id.Account.User,
+		Provider: id.Account.Provider,
+	}
+	if id.Account.ProviderKeyPin != nil {
+		ki.ProviderKeyPin = id.Account.ProviderKeyPin.Bytes()
+	}
+	plaintext, err := json.Marshal(ki)
+	if err != nil {
+		return err
+	}
+
+	kf := &keystoreFile{
+		Version: keystoreVersion,
+		Salt:    make([]byte, keystoreSaltSize),
+		Nonce:   make([]byte, keystoreNonceSize),
+	}
+	if _, err = io.ReadFull(rand.Reader, kf.Salt); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(rand.Reader, kf.Nonce); err != nil {
+		return err
+	}
+	var nonce [keystoreNonceSize]byte
+	copy(nonce[:], kf.Nonce)
+	kf.Ciphertext = secretbox.Seal(nil, plaintext, &nonce, keystoreKey(passphrase, kf.Salt))
+	raw, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// LoadIdentity reads the keystore file and decrypts the identity with the
+// passphrase.  ErrKeystoreNotFound is returned if the file does not exist,
+// and ErrKeystoreEmptyPassphrase if the passphrase is empty.
+func LoadIdentity(fileName, passphrase string) (*Identity, error) {
+	if passphrase == "" {
+		return nil, ErrKeystoreEmptyPassphrase
+	}
+	raw, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, ErrKeystoreNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	kf := new(keystoreFile)
+	if err = json.Unmarshal(raw, kf); err != nil {
+		return nil, fmt.Errorf("keystore: malformed file: %v", err)
+	}
+	if kf.Version != keystoreVersion {
+		return nil, fmt.Errorf("keystore: unsupported version: %v", kf.Version)
+	}
+	if len(kf.Nonce) != keystoreNonceSize {
+		return nil, errors.New("keystore: malformed nonce")
+	}
+	var nonce [keystoreNonceSize]byte
+	copy(nonce[:], kf.Nonce)
+	plaintext, ok := secretbox.Open(nil, kf.Ciphertext, &nonce, keystoreKey(passphrase, kf.Salt))
+	if !ok {
+		return nil, ErrKeystoreDecrypt
+	}
+
+	ki := new(keystoreIdentity)
+	if err = json.Unmarshal(plaintext, ki); err != nil {
+		return nil, fmt.Errorf("keystore: malformed identity: %v", err)
+	}
+	linkKey := new(ecdh.PrivateKey)
+	if err = linkKey.FromBytes(ki.LinkKey); err != nil {
+		return nil, fmt.Errorf("keystore: invalid link key: %v", err)
+	}
+	account := &config.Account{
+		User:     ki.User,
+		Provider: ki.Provider,
+	}
+	if ki.ProviderKeyPin != nil {
+		account.ProviderKeyPin = new(eddsa.PublicKey)
+		if err = account.ProviderKeyPin.FromBytes(ki.ProviderKeyPin); err != nil {
+			return nil, fmt.Errorf("keystore: invalid provider key pin: %v", err)
+		}
+	}
+	return &Identity{
+		LinkKey: linkKey,
+		Account: account,
+	}, nil
+}
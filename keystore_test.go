@@ -0,0 +1,56 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeystore(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "meson-client-keystore")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, "keystore.json")
+
+	_, err = LoadIdentity(fileName, "passphrase")
+	assert.Equal(ErrKeystoreNotFound, err)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	idKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	id := &Identity{
+		LinkKey: linkKey,
+		Account: &config.Account{
+			User:           "alice",
+			Provider:       "provider1",
+			ProviderKeyPin: idKey.PublicKey(),
+		},
+	}
+	assert.Equal(ErrKeystoreEmptyPassphrase, SaveIdentity(fileName, "", id))
+	require.NoError(SaveIdentity(fileName, "passphrase", id))
+
+	_, err = LoadIdentity(fileName, "")
+	assert.Equal(ErrKeystoreEmptyPassphrase, err)
+
+	_, err = LoadIdentity(fileName, "wrong passphrase")
+	assert.Equal(ErrKeystoreDecrypt, err)
+
+	loaded, err := LoadIdentity(fileName, "passphrase")
+	require.NoError(err)
+	assert.Equal(linkKey.Bytes(), loaded.LinkKey.Bytes())
+	assert.Equal("alice", loaded.Account.User)
+	assert.Equal("provider1", loaded.Account.Provider)
+	assert.True(idKey.PublicKey().Equal(loaded.Account.ProviderKeyPin))
+}
@@ -63,7 +63,16 @@ type Message struct {
 	// Specifies if this message is a decoy.
 	IsDecoy bool
 
-	// Priority controls the dwell time in the current AQM.
+	// Reliable indicates whether or not the message is retransmitted
+	// until a reply is received.
+	Reliable bool
+
+	// ReplyCheck, if set, validates the reply payload and sets the Err of
+	// the MessageReplyEvent.  It is not persisted.
+	ReplyCheck func(reply []byte) error `json:"-"`
+
+	// Priority controls the dwell time in the current AQM, messages with
+	// a higher priority are sent first by the PriorityQueue.
 	QueuePriority uint64
 }
 
@@ -25,6 +25,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashcloak/Meson-client/clock"
 	kpki "github.com/hashcloak/Meson-client/pkiclient"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
@@ -106,6 +107,14 @@ type ClientConfig struct {
 	// EnableTimeSync enables the use of skewed remote provider time
 	// instead of system time when available.
 	EnableTimeSync bool
+
+	// Clock is the optional source of time, the system clock is used if
+	// left unset.
+	Clock clock.Clock
+
+	// Rand is the optional source of randomness for the path selection
+	// and hop delays, a new rand.NewMath instance is used if left unset.
+	Rand *mRand.Rand
 }
 
 func (cfg *ClientConfig) validate() error {
@@ -145,9 +154,10 @@ type Client struct {
 	cfg *ClientConfig
 	log *logging.Logger
 
-	rng  *mRand.Rand
-	pki  *pki
-	conn *connection
+	rng   *mRand.Rand
+	clock clock.Clock
+	pki   *pki
+	conn  *connection
 
 	displayName string
 
@@ -199,7 +209,14 @@ func New(cfg *ClientConfig) (*Client, error) {
 	c.log.Debugf("User/Provider is: %v", c.displayName)
 	c.log.Debugf("User Link Key is: %v", c.cfg.LinkKey.PublicKey())
 
-	c.rng = rand.NewMath()
+	c.rng = cfg.Rand
+	if c.rng == nil {
+		c.rng = rand.NewMath()
+	}
+	c.clock = cfg.Clock
+	if c.clock == nil {
+		c.clock = clock.Real
+	}
 
 	c.conn = newConnection(c)
 	c.pki = newPKI(c)
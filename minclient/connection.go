@@ -26,7 +26,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
 	"github.com/katzenpost/core/crypto/rand"
 	cpki "github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/wire"
@@ -188,19 +187,19 @@ func (c *connection) connectWorker() {
 		}
 	}()
 
-	timer := time.NewTimer(0)
+	timer := c.c.clock.NewTimer(0)
 	defer timer.Stop()
 	for {
 		// Wait pki flush time
 		select {
 		case <-c.HaltCh():
 			return
-		case <-timer.C:
+		case <-timer.C():
 			timer.Reset(pkiFlushInterval)
 		}
 
 		// Only need to update PKI when seeing a new epoch
-		if now, _, _, _ := epochtime.Now(c.c.cfg.PKIClient); now != c.pkiEpoch {
+		if now, _, _, _ := c.c.epochNow(); now != c.pkiEpoch {
 			// Query the PKI for the current descriptor.
 			if err := c.getDescriptor(); err == nil {
 				// Attempt to connect.
@@ -263,7 +262,7 @@ func (c *connection) doConnect(dialCtx context.Context) {
 
 		for _, addrPort := range dstAddrs {
 			select {
-			case <-time.After(time.Duration(atomic.LoadInt64(&c.retryDelay))):
+			case <-c.c.clock.After(time.Duration(atomic.LoadInt64(&c.retryDelay))):
 				// Back off the reconnect delay.
 				atomic.AddInt64(&c.retryDelay, int64(retryIncrement))
 				if atomic.LoadInt64(&c.retryDelay) > int64(maxRetryDelay) {
@@ -335,7 +334,7 @@ func (c *connection) onTCPConn(conn net.Conn) {
 	defer w.Close()
 
 	// Bind the session to the conn, handshake, authenticate.
-	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	_ = conn.SetDeadline(c.c.clock.Now().Add(handshakeTimeout))
 	if err = w.Initialize(conn); err != nil {
 		c.log.Errorf("Handshake failed: %v", err)
 		if c.c.cfg.OnConnFn != nil {
@@ -419,7 +418,7 @@ func (c *connection) onWireConn(w *wire.Session) {
 	var fetchDelay time.Duration
 	var selectAt time.Time
 	adjFetchDelay := func() {
-		sendAt := time.Now()
+		sendAt := c.c.clock.Now()
 		if deltaT := sendAt.Sub(selectAt); deltaT < fetchDelay {
 			fetchDelay = fetchDelay - deltaT
 		} else {
@@ -437,9 +436,9 @@ func (c *connection) onWireConn(w *wire.Session) {
 	for {
 		var rawCmd commands.Command
 		var doFetch bool
-		selectAt = time.Now()
+		selectAt = c.c.clock.Now()
 		select {
-		case <-time.After(fetchDelay):
+		case <-c.c.clock.After(fetchDelay):
 			doFetch = true
 		case <-c.fetchCh:
 			doFetch = true
@@ -85,17 +85,26 @@ func (p *pki) setClockSkew(skew int64) {
 
 func (p *pki) skewedUnixTime() int64 {
 	if !p.c.cfg.EnableTimeSync {
-		return time.Now().Unix()
+		return p.c.clock.Now().Unix()
 	}
 
 	p.Lock()
 	defer p.Unlock()
 
-	return time.Now().Unix() + p.clockSkew
+	return p.c.clock.Now().Unix() + p.clockSkew
+}
+
+// epochNow returns the current epoch, the time elapsed since it began and
+// the time until the next one.  The epochs are those of the PKI client's
+// chain rather than of the clock, so tests replace PKIClient to control them.
+// Unlike the time the packets are composed with, the epoch is not corrected
+// by the clock skew, as the chain does not depend on the host clock.
+func (c *Client) epochNow() (epoch uint64, elapsed, till time.Duration, err error) {
+	return epochtime.Now(c.cfg.PKIClient)
 }
 
 func (p *pki) currentDocument() *cpki.Document {
-	now, _, _, err := epochtime.Now(p.c.cfg.PKIClient)
+	now, _, _, err := p.c.epochNow()
 	if err != nil {
 		p.log.Debugf("Couldn't find epoch: %+v", err)
 		return nil
@@ -114,7 +123,7 @@ func (p *pki) currentDocument() *cpki.Document {
 func (p *pki) worker() {
 	const initialSpawnDelay = 3 * time.Second
 
-	timer := time.NewTimer(initialSpawnDelay)
+	timer := p.c.clock.NewTimer(initialSpawnDelay)
 	defer func() {
 		p.log.Debug("Halting PKI worker.")
 		timer.Stop()
@@ -129,15 +138,15 @@ func (p *pki) worker() {
 			close(p.doneWorkerCh)
 			return
 		case <-p.forceUpdateCh:
-		case <-timer.C:
+		case <-timer.C():
 			timerFired = true
 		}
 		if !timerFired && !timer.Stop() {
-			<-timer.C
+			<-timer.C()
 		}
 
 		// Determine which documents to fetch.
-		now, _, _, err := epochtime.Now(p.c.cfg.PKIClient)
+		now, _, _, err := p.c.epochNow()
 		if err != nil {
 			p.log.Debugf("Couldn't find epoch: %+v", err)
 			continue
@@ -0,0 +1,77 @@
+package minclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errNoDocument = errors.New("no document")
+
+// testPKIClient is a PKI client at a fixed height of its chain.
+type testPKIClient struct {
+	epoch         uint64
+	elapsedHeight uint64
+}
+
+func (c *testPKIClient) GetEpoch(context.Context) (uint64, uint64, error) {
+	return c.epoch, c.elapsedHeight, nil
+}
+
+func (c *testPKIClient) GetDoc(context.Context, uint64) (*cpki.Document, []byte, error) {
+	return nil, nil, errNoDocument
+}
+
+func (c *testPKIClient) Post(context.Context, uint64, *eddsa.PrivateKey, *cpki.MixDescriptor) error {
+	return nil
+}
+
+func (c *testPKIClient) Deserialize([]byte) (*cpki.Document, error) {
+	return nil, errNoDocument
+}
+
+func (c *testPKIClient) Shutdown() {}
+
+func TestEpochWithClockSkew(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	logBackend, err := log.New("", "ERROR", true)
+	require.NoError(err)
+	clk := clock.NewFake(time.Unix(1000, 0))
+	c := &Client{
+		cfg: &ClientConfig{
+			PKIClient:      &testPKIClient{epoch: 8, elapsedHeight: 5},
+			LogBackend:     logBackend,
+			EnableTimeSync: true,
+		},
+		clock: clk,
+	}
+	c.pki = newPKI(c)
+	doc := &cpki.Document{Epoch: 7}
+	c.pki.docs.Store(uint64(7), doc)
+
+	// the skew corrects the packet time but not the epoch of the chain
+	for _, skew := range []int64{0, 60, -60} {
+		c.pki.setClockSkew(skew)
+		assert.Equal(time.Duration(skew)*time.Second, c.ClockSkew())
+		epoch, elapsed, _, err := c.epochNow()
+		require.NoError(err)
+		assert.Equal(uint64(7), epoch)
+		assert.Equal(epochtime.TestPeriod/2, elapsed)
+		assert.True(doc == c.pki.currentDocument())
+		assert.Equal(clk.Now().Unix()+skew, c.pki.skewedUnixTime())
+	}
+
+	c.cfg.EnableTimeSync = false
+	assert.Equal(clk.Now().Unix(), c.pki.skewedUnixTime())
+}
@@ -49,11 +49,11 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 
 	for {
 		unixTime := c.pki.skewedUnixTime()
-		epoch, _, budget, err := epochtime.Now(c.cfg.PKIClient)
+		epoch, _, budget, err := c.epochNow()
 		if err != nil {
 			return nil, nil, 0, err
 		}
-		start := time.Now()
+		start := c.clock.Now()
 
 		// Select the forward path.
 		now := time.Unix(unixTime, 0)
@@ -73,7 +73,7 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 
 		// If the path selection process ends up straddling an epoch
 		// transition, then redo the path selection.
-		if time.Since(start) > budget {
+		if c.clock.Now().Sub(start) > budget {
 			continue
 		}
 
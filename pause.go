@@ -0,0 +1,137 @@
+// pause.go - Session suspension.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPaused is the error issued when the session is already paused.
+var ErrPaused = errors.New("session is paused")
+
+// ErrNotPaused is the error issued when resuming a session which is not
+// paused.
+var ErrNotPaused = errors.New("session is not paused")
+
+type opPause struct {
+	paused bool
+	done   chan struct{}
+}
+
+// Pause suspends the session, for instance while the host sleeps.  The cover
+// traffic is stopped, the egress queue is held and the Provider connection
+// is dropped, but the SURB state is kept and nothing expires until Resume.
+func (s *Session) Pause() error {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if s.isPaused() {
+		return ErrPaused
+	}
+	if err := s.setWorkerPaused(true); err != nil {
+		return err
+	}
+
+	client := s.currentMinclient()
+	doc := client.CurrentDocument()
+	s.minclientLock.Lock()
+	s.paused = true
+	s.pausedAt = s.clock.Now()
+	s.lastDocument = doc
+	// Ignore the disconnection of the instance being shut down.
+	atomic.AddUint64(&s.clientGeneration, 1)
+	s.minclientLock.Unlock()
+	client.Shutdown()
+	client.Wait()
+
+	s.log.Notice("Session paused")
+	s.eventCh.In() <- &SessionPausedEvent{}
+	return nil
+}
+
+// Resume reconnects a paused session to its Provider, which refreshes the
+// PKI document, and restarts the traffic.
+func (s *Session) Resume() error {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+	if !s.isPaused() {
+		return ErrNotPaused
+	}
+
+	s.minclientLock.RLock()
+	pausedFor := s.clock.Now().Sub(s.pausedAt)
+	s.minclientLock.RUnlock()
+	// The replies to the messages in flight waited at the Provider.
+	s.postponeInFlight(pausedFor)
+	if _, err := s.replaceMinclient(s.Account()); err != nil {
+		return err
+	}
+	s.minclientLock.Lock()
+	s.paused = false
+	s.lastDocument = nil
+	s.minclientLock.Unlock()
+	if err := s.setWorkerPaused(false); err != nil {
+		return err
+	}
+
+	s.log.Noticef("Session resumed after %v", pausedFor)
+	s.eventCh.In() <- &SessionResumedEvent{
+		PausedFor: pausedFor,
+	}
+	return nil
+}
+
+// IsPaused returns true while the session is paused.
+func (s *Session) IsPaused() bool {
+	return s.isPaused()
+}
+
+func (s *Session) isPaused() bool {
+	s.minclientLock.RLock()
+	defer s.minclientLock.RUnlock()
+	return s.paused
+}
+
+// setWorkerPaused returns once the worker stopped or restarted sending.
+func (s *Session) setWorkerPaused(paused bool) error {
+	op := opPause{
+		paused: paused,
+		done:   make(chan struct{}),
+	}
+	select {
+	case s.opCh <- op:
+	case <-s.HaltCh():
+		return ErrSessionShutdown
+	}
+	select {
+	case <-op.done:
+	case <-s.HaltCh():
+		return ErrSessionShutdown
+	}
+	return nil
+}
+
+// postponeInFlight shifts the send time of the messages awaiting a reply so
+// that the time spent paused does not count towards their reply timeout.
+func (s *Session) postponeInFlight(d time.Duration) {
+	s.surbIDMap.Range(func(_, rawMessage interface{}) bool {
+		message := rawMessage.(*Message)
+		message.SentAt = message.SentAt.Add(d)
+		return true
+	})
+}
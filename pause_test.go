@@ -0,0 +1,116 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/hashcloak/Meson-client/minclient"
+	cConstants "github.com/katzenpost/client/constants"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostponeInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	sentAt := time.Unix(1000, 0)
+	s := new(Session)
+	msg := &Message{
+		ID:     new([cConstants.MessageIDLength]byte),
+		SentAt: sentAt,
+	}
+	s.surbIDMap.Store([sConstants.SURBIDLength]byte{1}, msg)
+
+	s.postponeInFlight(time.Hour)
+	assert.Equal(sentAt.Add(time.Hour), msg.SentAt)
+}
+
+func TestResumeNotPaused(t *testing.T) {
+	s := new(Session)
+	assert.False(t, s.IsPaused())
+	assert.Equal(t, ErrNotPaused, s.Resume())
+}
+
+func TestPauseResume(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	doc := newTestPolicyDocument(3, 1, 1, 1)
+	client := newTestMinclient(doc)
+	s := newTestSession(clk, client)
+	s.account = &config.Account{User: "alice", Provider: "provider"}
+	scheduler := newTestScheduler(100*time.Millisecond, time.Hour, time.Hour)
+	s.scheduler = scheduler
+
+	newDoc := newTestPolicyDocument(3, 1, 1, 1)
+	newDoc.Epoch = 2
+	resumed := newTestMinclient(newDoc)
+	var resumedCfg *minclient.ClientConfig
+	s.newMinclient = func(cfg *minclient.ClientConfig) (providerClient, error) {
+		resumedCfg = cfg
+		return resumed, nil
+	}
+
+	s.Go(s.worker)
+	defer s.Halt()
+	scheduler.awaitNext(t, TrafficSend, TrafficLoopDecoy, TrafficDropDecoy)
+	s.opCh <- opConnStatusChanged{isConnected: true}
+	scheduler.awaitNext(t, TrafficSend, TrafficLoopDecoy, TrafficDropDecoy)
+
+	require.NoError(s.Pause())
+	assert.True(s.IsPaused())
+	assert.Equal(ErrPaused, s.Pause())
+	// the connection was dropped and its last document is kept
+	client.Wait()
+	client.doc = nil
+	assert.True(doc == s.CurrentDocument())
+
+	// the traffic is stopped and the queue is held
+	msg := newTestMessage(1)
+	msg.IsBlocking = false
+	require.NoError(s.enqueue(msg))
+	clk.Advance(2 * time.Hour)
+	assertNothingSent(t, client)
+	select {
+	case kind := <-scheduler.nextCh:
+		t.Fatalf("traffic %v scheduled while paused", kind)
+	default:
+	}
+	_, err := s.egressQueue.Peek()
+	require.NoError(err)
+
+	require.NoError(s.Resume())
+	assert.False(s.IsPaused())
+	assert.Equal(ErrNotPaused, s.Resume())
+	require.NotNil(resumedCfg)
+	assert.Equal("alice", resumedCfg.User)
+	assert.True(newDoc == s.CurrentDocument())
+
+	// nothing is sent until the new connection is up, after which the
+	// timers restart with fresh samples
+	clk.Advance(time.Hour)
+	assertNothingSent(t, resumed)
+	resumedCfg.OnConnFn(nil)
+	scheduler.awaitNext(t, TrafficSend, TrafficLoopDecoy, TrafficDropDecoy)
+	resumedCfg.OnDocumentFn(newDoc)
+	scheduler.awaitNext(t, TrafficSend, TrafficLoopDecoy, TrafficDropDecoy)
+	assert.True(newDoc == scheduler.doc)
+	clk.Advance(100 * time.Millisecond)
+	assert.Equal([]byte{1}, <-resumed.sent)
+
+	var paused, resumedEvent bool
+	for !paused || !resumedEvent {
+		switch e := (<-s.eventCh.Out()).(type) {
+		case *SessionPausedEvent:
+			paused = true
+		case *SessionResumedEvent:
+			require.True(paused)
+			resumedEvent = true
+			assert.Equal(2*time.Hour, e.PausedFor)
+		}
+	}
+}
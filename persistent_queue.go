@@ -0,0 +1,424 @@
+// persistent_queue.go - Disk backed egress queue.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	dbm "github.com/tendermint/tm-db"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	persistentQueueKeyLength = 8
+
+	// PersistentQueueKeySize is the size of the key encrypting the
+	// messages of a PersistentQueue.
+	PersistentQueueKeySize = chacha20poly1305.KeySize
+
+	persistentQueueInfo = "meson-client egress queue v0"
+)
+
+// PersistentQueue is an egress queue stored in a database so that queued
+// messages survive a restart.  Like the PriorityQueue, it sends the
+// messages with the highest QueuePriority first, messages of equal
+// priority in FIFO order, and raises the priority of queued messages by
+// one every aging interval.  Each message is encrypted, and only what is
+// needed to send it again is stored: the SURB, the time it was sent and its
+// reply are not.
+type PersistentQueue struct {
+	sync.Mutex
+
+	db            dbm.DB
+	aead          cipher.AEAD
+	clock         clock.Clock
+	agingInterval time.Duration
+	tail          uint64
+
+	// cache holds the decoded messages by sequence number so that the
+	// same *Message is returned until it is popped.
+	cache map[uint64]*priorityEntry
+
+	// peeked is the entry returned by Peek which the next Pop removes.
+	peeked *priorityEntry
+}
+
+func persistentQueueKey(seq uint64) []byte {
+	var key [persistentQueueKeyLength]byte
+	binary.BigEndian.PutUint64(key[:], seq)
+	return key[:]
+}
+
+// persistentMessage is the part of a Message stored by a PersistentQueue.
+type persistentMessage struct {
+	ID            []byte
+	Recipient     string
+	Provider      string
+	Payload       []byte
+	WithSURB      bool
+	IsDecoy       bool
+	Reliable      bool
+	QueuePriority uint64
+}
+
+// PersistentQueueKey derives the key encrypting the messages of a
+// PersistentQueue from the link key.
+func PersistentQueueKey(linkKey *ecdh.PrivateKey) ([]byte, error) {
+	key := make([]byte, PersistentQueueKeySize)
+	kdf := hkdf.New(sha256.New, linkKey.Bytes(), nil, []byte(persistentQueueInfo))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewPersistentQueue returns a PersistentQueue stored in db, whose messages
+// are encrypted with key and aged every agingInterval, loading the messages
+// it already holds.  The loaded messages are not blocking, as their caller
+// is gone, even if they were when pushed, and they age from the time they
+// are loaded.
+func NewPersistentQueue(db dbm.DB, key []byte, agingInterval time.Duration) (*PersistentQueue, error) {
+	return NewPersistentQueueWithClock(db, key, agingInterval, clock.Real)
+}
+
+// NewPersistentQueueWithClock is like NewPersistentQueue but the messages
+// are aged according to the given clock.
+func NewPersistentQueueWithClock(db dbm.DB, key []byte, agingInterval time.Duration, clk clock.Clock) (*PersistentQueue, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if agingInterval <= 0 {
+		agingInterval = DefaultAgingInterval
+	}
+	q := &PersistentQueue{
+		db:            db,
+		aead:          aead,
+		clock:         clk,
+		agingInterval: agingInterval,
+		cache:         make(map[uint64]*priorityEntry),
+	}
+	it, err := db.Iterator(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	now := clk.Now()
+	for ; it.Valid(); it.Next() {
+		if len(it.Key()) != persistentQueueKeyLength {
+			return nil, fmt.Errorf("persistent queue: invalid key %x", it.Key())
+		}
+		seq := binary.BigEndian.Uint64(it.Key())
+		msg, err := q.open(seq, it.Value())
+		if err != nil {
+			return nil, fmt.Errorf("persistent queue: invalid message %d: %v", seq, err)
+		}
+		q.cache[seq] = &priorityEntry{
+			item:       msg,
+			seq:        seq,
+			enqueuedAt: now,
+		}
+		q.tail = seq + 1
+	}
+	if err = it.Error(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// OpenPersistentQueue opens or creates the named LevelDB backed
+// PersistentQueue in dir, whose messages are encrypted with key and aged
+// every agingInterval.
+func OpenPersistentQueue(name, dir string, key []byte, agingInterval time.Duration) (*PersistentQueue, error) {
+	return OpenPersistentQueueWithClock(name, dir, key, agingInterval, clock.Real)
+}
+
+// OpenPersistentQueueWithClock is like OpenPersistentQueue but the messages
+// are aged according to the given clock.
+func OpenPersistentQueueWithClock(name, dir string, key []byte, agingInterval time.Duration, clk clock.Clock) (*PersistentQueue, error) {
+	db, err := dbm.NewDB(name, dbm.GoLevelDBBackend, dir)
+	if err != nil {
+		return nil, err
+	}
+	q, err := NewPersistentQueueWithClock(db, key, agingInterval, clk)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// seal encrypts the message stored under seq, which is authenticated so that
+// records cannot be reordered.
+func (q *PersistentQueue) seal(seq uint64, msg *Message) ([]byte, error) {
+	raw, err := json.Marshal(&persistentMessage{
+		ID:            msg.ID[:],
+		Recipient:     msg.Recipient,
+		Provider:      msg.Provider,
+		Payload:       msg.Payload,
+		WithSURB:      msg.WithSURB,
+		IsDecoy:       msg.IsDecoy,
+		Reliable:      msg.Reliable,
+		QueuePriority: msg.QueuePriority,
+	})
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, q.aead.NonceSize(), q.aead.NonceSize()+len(raw)+q.aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return q.aead.Seal(nonce, nonce, raw, persistentQueueKey(seq)), nil
+}
+
+func (q *PersistentQueue) open(seq uint64, sealed []byte) (*Message, error) {
+	if len(sealed) < q.aead.NonceSize() {
+		return nil, errors.New("record too short")
+	}
+	nonce := sealed[:q.aead.NonceSize()]
+	raw, err := q.aead.Open(nil, nonce, sealed[q.aead.NonceSize():], persistentQueueKey(seq))
+	if err != nil {
+		return nil, errors.New("decryption failed, wrong key?")
+	}
+	m := new(persistentMessage)
+	if err = json.Unmarshal(raw, m); err != nil {
+		return nil, err
+	}
+	if len(m.ID) != constants.MessageIDLength {
+		return nil, fmt.Errorf("invalid message ID length %d", len(m.ID))
+	}
+	msg := &Message{
+		ID:            new([constants.MessageIDLength]byte),
+		Recipient:     m.Recipient,
+		Provider:      m.Provider,
+		Payload:       m.Payload,
+		WithSURB:      m.WithSURB,
+		IsDecoy:       m.IsDecoy,
+		Reliable:      m.Reliable,
+		QueuePriority: m.QueuePriority,
+	}
+	copy(msg.ID[:], m.ID)
+	return msg, nil
+}
+
+// Push pushes the given message onto the queue and returns nil
+// on success, otherwise an error is returned.
+func (q *PersistentQueue) Push(e Item) error {
+	msg, ok := e.(*Message)
+	if !ok {
+		return fmt.Errorf("persistent queue: unsupported item type %T", e)
+	}
+	q.Lock()
+	defer q.Unlock()
+	if len(q.cache) >= constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	raw, err := q.seal(q.tail, msg)
+	if err != nil {
+		return err
+	}
+	if err = q.db.SetSync(persistentQueueKey(q.tail), raw); err != nil {
+		return err
+	}
+	q.cache[q.tail] = &priorityEntry{
+		item:       msg,
+		seq:        q.tail,
+		enqueuedAt: q.clock.Now(),
+	}
+	q.tail++
+	return nil
+}
+
+// PushBatch atomically pushes the given messages onto the queue and
+// returns nil on success, otherwise an error is returned and none of them
+// are pushed.
+func (q *PersistentQueue) PushBatch(items []Item) error {
+	messages := make([]*Message, 0, len(items))
+	for _, e := range items {
+		msg, ok := e.(*Message)
+		if !ok {
+			return fmt.Errorf("persistent queue: unsupported item type %T", e)
+		}
+		messages = append(messages, msg)
+	}
+	q.Lock()
+	defer q.Unlock()
+	if len(q.cache)+len(messages) > constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	batch := q.db.NewBatch()
+	defer batch.Close()
+	for i, msg := range messages {
+		seq := q.tail + uint64(i)
+		raw, err := q.seal(seq, msg)
+		if err != nil {
+			return err
+		}
+		if err = batch.Set(persistentQueueKey(seq), raw); err != nil {
+			return err
+		}
+	}
+	if err := batch.WriteSync(); err != nil {
+		return err
+	}
+	now := q.clock.Now()
+	for _, msg := range messages {
+		q.cache[q.tail] = &priorityEntry{
+			item:       msg,
+			seq:        q.tail,
+			enqueuedAt: now,
+		}
+		q.tail++
+	}
+	return nil
+}
+
+// next returns the entry to send next, the one returned by the last Peek
+// if it is still queued.
+func (q *PersistentQueue) next() *priorityEntry {
+	if q.peeked != nil {
+		return q.peeked
+	}
+	now := q.clock.Now()
+	var best *priorityEntry
+	var bestPriority uint64
+	for _, e := range q.cache {
+		p := agedPriority(e, now, q.agingInterval)
+		if best == nil || p > bestPriority || (p == bestPriority && e.seq < best.seq) {
+			best, bestPriority = e, p
+		}
+	}
+	return best
+}
+
+// Pop pops the next message off the queue and returns nil
+// upon success, otherwise an error is returned.
+func (q *PersistentQueue) Pop() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.cache) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	e := q.next()
+	if err := q.db.DeleteSync(persistentQueueKey(e.seq)); err != nil {
+		return nil, err
+	}
+	delete(q.cache, e.seq)
+	q.peeked = nil
+	return e.item, nil
+}
+
+// Peek returns the next message from the queue without
+// modifying the queue.
+func (q *PersistentQueue) Peek() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.cache) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	q.peeked = q.next()
+	return q.peeked.item, nil
+}
+
+// sequence returns the sequence numbers of the queued messages in order.
+func (q *PersistentQueue) sequence() []uint64 {
+	seqs := make([]uint64, 0, len(q.cache))
+	for seq := range q.cache {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// Messages returns the queued messages, oldest first.
+func (q *PersistentQueue) Messages() []*Message {
+	q.Lock()
+	defer q.Unlock()
+	messages := make([]*Message, 0, len(q.cache))
+	for _, seq := range q.sequence() {
+		messages = append(messages, q.cache[seq].item.(*Message))
+	}
+	return messages
+}
+
+// Remove removes the oldest message for which match returns true and
+// returns it, otherwise ErrQueueItemNotFound is returned.
+func (q *PersistentQueue) Remove(match func(Item) bool) (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	for _, seq := range q.sequence() {
+		e := q.cache[seq]
+		if !match(e.item) {
+			continue
+		}
+		if err := q.db.DeleteSync(persistentQueueKey(seq)); err != nil {
+			return nil, err
+		}
+		delete(q.cache, seq)
+		if q.peeked == e {
+			q.peeked = nil
+		}
+		return e.item, nil
+	}
+	return nil, ErrQueueItemNotFound
+}
+
+// Close closes the underlying database.
+func (q *PersistentQueue) Close() error {
+	return q.db.Close()
+}
+
+// newEgressQueue returns the egress queue selected in the configuration.
+// The persistent queue is named after the link key, which unlike the
+// account survives a Provider failover.
+func newEgressQueue(cfg *config.Config, linkKey *ecdh.PrivateKey, clk clock.Clock) (EgressQueue, error) {
+	if cfg.EgressQueue == nil {
+		return new(Queue), nil
+	}
+	switch cfg.EgressQueue.Backend {
+	case "", config.EgressQueueMemory:
+		return new(Queue), nil
+	case config.EgressQueuePriority:
+		return NewPriorityQueueWithClock(time.Duration(cfg.EgressQueue.AgingInterval)*time.Second, clk), nil
+	case config.EgressQueueLevelDB:
+		digest := sha256.Sum256(linkKey.PublicKey().Bytes())
+		name := fmt.Sprintf("egress_%x", digest[:8])
+		key, err := PersistentQueueKey(linkKey)
+		if err != nil {
+			return nil, err
+		}
+		agingInterval := time.Duration(cfg.EgressQueue.AgingInterval) * time.Second
+		return OpenPersistentQueueWithClock(name, cfg.EgressQueue.Directory, key, agingInterval, clk)
+	default:
+		return nil, errors.New("invalid egress queue backend")
+	}
+}
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	dbm "github.com/tendermint/tm-db"
+)
+
+func newTestMessage(b byte) *Message {
+	id := new([constants.MessageIDLength]byte)
+	id[0] = b
+	return &Message{
+		ID:         id,
+		Recipient:  "recipient",
+		Provider:   "provider",
+		Payload:    []byte{b},
+		WithSURB:   true,
+		IsBlocking: true,
+	}
+}
+
+var testQueueKey = make([]byte, PersistentQueueKeySize)
+
+func TestPersistentQueue(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	db := dbm.NewMemDB()
+	q, err := NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	_, err = q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+	assert.Error(q.Push(foo{"hello"}))
+
+	for i := 0; i < constants.MaxEgressQueueSize; i++ {
+		require.NoError(q.Push(newTestMessage(byte(i))))
+	}
+	assert.Equal(ErrQueueFull, q.Push(newTestMessage(0)))
+
+	// the same message is returned until it is popped
+	m1, err := q.Peek()
+	require.NoError(err)
+	m2, err := q.Pop()
+	require.NoError(err)
+	assert.True(m1 == m2)
+	assert.Equal(byte(0), m2.(*Message).ID[0])
+
+	// reload from the database
+	q, err = NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	messages := q.Messages()
+	require.Equal(constants.MaxEgressQueueSize-1, len(messages))
+	for i, msg := range messages {
+		assert.Equal(byte(i+1), msg.ID[0])
+		assert.Equal([]byte{byte(i + 1)}, msg.Payload)
+		assert.False(msg.IsBlocking)
+	}
+	for i := 1; i < constants.MaxEgressQueueSize; i++ {
+		m, err := q.Pop()
+		require.NoError(err)
+		assert.Equal(byte(i), m.(*Message).ID[0])
+	}
+	_, err = q.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+
+	// sequence numbers keep increasing after a reload
+	require.NoError(q.Push(newTestMessage(42)))
+	q, err = NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	m, err := q.Pop()
+	require.NoError(err)
+	assert.Equal(byte(42), m.(*Message).ID[0])
+}
+
+func TestPersistentQueueRemove(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	db := dbm.NewMemDB()
+	q, err := NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		require.NoError(q.Push(newTestMessage(byte(i))))
+	}
+	match := func(b byte) func(Item) bool {
+		return func(i Item) bool {
+			return i.(*Message).ID[0] == b
+		}
+	}
+	_, err = q.Remove(match(42))
+	assert.Equal(ErrQueueItemNotFound, err)
+	m, err := q.Remove(match(0))
+	require.NoError(err)
+	assert.Equal(byte(0), m.(*Message).ID[0])
+	_, err = q.Remove(match(1))
+	require.NoError(err)
+
+	// the removal is persisted
+	q, err = NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	m, err = q.Peek()
+	require.NoError(err)
+	assert.Equal(byte(2), m.(*Message).ID[0])
+	assert.Equal(1, len(q.Messages()))
+	_, err = q.Pop()
+	require.NoError(err)
+	_, err = q.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+}
+
+func TestPersistentQueuePushBatch(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	db := dbm.NewMemDB()
+	q, err := NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	for i := 0; i < constants.MaxEgressQueueSize-1; i++ {
+		require.NoError(q.Push(newTestMessage(byte(i))))
+	}
+	batch := []Item{newTestMessage(200), newTestMessage(201)}
+	assert.Equal(ErrQueueFull, q.PushBatch(batch))
+	assert.Error(q.PushBatch([]Item{foo{"hello"}}))
+	_, err = q.Pop()
+	require.NoError(err)
+	require.NoError(q.PushBatch(batch))
+
+	// the batch is persisted
+	q, err = NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	require.NoError(err)
+	messages := q.Messages()
+	require.Len(messages, constants.MaxEgressQueueSize)
+	assert.Equal(byte(200), messages[len(messages)-2].ID[0])
+	assert.Equal(byte(201), messages[len(messages)-1].ID[0])
+}
+
+func TestPersistentQueueEncryption(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	key, err := PersistentQueueKey(linkKey)
+	require.NoError(err)
+
+	db := dbm.NewMemDB()
+	q, err := NewPersistentQueue(db, key, DefaultAgingInterval)
+	require.NoError(err)
+	msg := newTestMessage(1)
+	msg.Payload = []byte("secret payload")
+	msg.Key = []byte("secret SURB key")
+	msg.Reliable = true
+	require.NoError(q.Push(msg))
+
+	raw, err := db.Get(persistentQueueKey(0))
+	require.NoError(err)
+	assert.False(bytes.Contains(raw, msg.Payload))
+	assert.False(bytes.Contains(raw, msg.Key))
+
+	q, err = NewPersistentQueue(db, key, DefaultAgingInterval)
+	require.NoError(err)
+	messages := q.Messages()
+	require.Len(messages, 1)
+	assert.Equal(msg.ID, messages[0].ID)
+	assert.Equal(msg.Payload, messages[0].Payload)
+	assert.True(messages[0].Reliable)
+	assert.Nil(messages[0].Key)
+
+	_, err = NewPersistentQueue(db, testQueueKey, DefaultAgingInterval)
+	assert.Error(err)
+
+	// records cannot be moved around
+	require.NoError(db.Set(persistentQueueKey(1), raw))
+	_, err = NewPersistentQueue(db, key, DefaultAgingInterval)
+	assert.Error(err)
+}
+
+func TestPersistentQueuePriority(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	db := dbm.NewMemDB()
+	q, err := NewPersistentQueueWithClock(db, testQueueKey, time.Minute, clk)
+	require.NoError(err)
+	for _, priority := range []uint64{0, 2, 1, 2} {
+		msg := newTestMessage(byte(priority))
+		msg.QueuePriority = priority
+		require.NoError(q.Push(msg))
+	}
+	m1, err := q.Peek()
+	require.NoError(err)
+	assert.Equal(uint64(2), m1.(*Message).QueuePriority)
+	// the peeked message is popped even if a higher priority one is pushed
+	msg := newTestMessage(5)
+	msg.QueuePriority = 5
+	require.NoError(q.Push(msg))
+	m2, err := q.Pop()
+	require.NoError(err)
+	assert.True(m1 == m2)
+
+	// the priorities are persisted, equal priorities are sent in FIFO order
+	q, err = NewPersistentQueueWithClock(db, testQueueKey, time.Minute, clk)
+	require.NoError(err)
+	for _, priority := range []uint64{5, 2, 1, 0} {
+		m, err := q.Pop()
+		require.NoError(err)
+		assert.Equal(priority, m.(*Message).QueuePriority)
+	}
+
+	// queued messages are aged
+	require.NoError(q.Push(newTestMessage(0)))
+	clk.Advance(2 * time.Minute)
+	msg = newTestMessage(1)
+	msg.QueuePriority = 1
+	require.NoError(q.Push(msg))
+	m, err := q.Pop()
+	require.NoError(err)
+	assert.Equal(uint64(0), m.(*Message).QueuePriority)
+}
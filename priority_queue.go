@@ -0,0 +1,184 @@
+// priority_queue.go - Priority egress queue.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/katzenpost/client/constants"
+)
+
+// DefaultAgingInterval is the default duration after which the priority of
+// a queued item is raised by one.
+const DefaultAgingInterval = 10 * time.Second
+
+type priorityEntry struct {
+	item       Item
+	seq        uint64
+	enqueuedAt time.Time
+}
+
+// PriorityQueue is an egress queue sending the items with the highest
+// Priority first, items of equal priority are sent in FIFO order.  The
+// priority of queued items is raised by one every aging interval so that
+// low priority items are not starved.
+type PriorityQueue struct {
+	sync.Mutex
+
+	clock         clock.Clock
+	agingInterval time.Duration
+	entries       []*priorityEntry
+	seq           uint64
+
+	// peeked is the entry returned by Peek which the next Pop removes,
+	// regardless of the items pushed and aged in between.
+	peeked *priorityEntry
+}
+
+// NewPriorityQueue returns a PriorityQueue aging items every agingInterval.
+func NewPriorityQueue(agingInterval time.Duration) *PriorityQueue {
+	return NewPriorityQueueWithClock(agingInterval, clock.Real)
+}
+
+// NewPriorityQueueWithClock is like NewPriorityQueue but the items are aged
+// according to the given clock.
+func NewPriorityQueueWithClock(agingInterval time.Duration, clk clock.Clock) *PriorityQueue {
+	if agingInterval <= 0 {
+		agingInterval = DefaultAgingInterval
+	}
+	return &PriorityQueue{
+		clock:         clk,
+		agingInterval: agingInterval,
+	}
+}
+
+// agedPriority returns the priority of the entry raised by one for every
+// agingInterval it spent queued.
+func agedPriority(e *priorityEntry, now time.Time, agingInterval time.Duration) uint64 {
+	age := uint64(now.Sub(e.enqueuedAt) / agingInterval)
+	p := e.item.Priority()
+	if p > math.MaxUint64-age {
+		return math.MaxUint64
+	}
+	return p + age
+}
+
+// next returns the index of the entry to send next.
+func (q *PriorityQueue) next() int {
+	if q.peeked != nil {
+		for i, e := range q.entries {
+			if e == q.peeked {
+				return i
+			}
+		}
+	}
+	now := q.clock.Now()
+	best := 0
+	bestPriority := agedPriority(q.entries[0], now, q.agingInterval)
+	for i := 1; i < len(q.entries); i++ {
+		p := agedPriority(q.entries[i], now, q.agingInterval)
+		if p > bestPriority || (p == bestPriority && q.entries[i].seq < q.entries[best].seq) {
+			best, bestPriority = i, p
+		}
+	}
+	return best
+}
+
+// Push pushes the given item onto the queue and returns nil
+// on success, otherwise an error is returned.
+func (q *PriorityQueue) Push(e Item) error {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries) >= constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	q.entries = append(q.entries, &priorityEntry{
+		item:       e,
+		seq:        q.seq,
+		enqueuedAt: q.clock.Now(),
+	})
+	q.seq++
+	return nil
+}
+
+// PushBatch pushes the given items onto the queue and returns nil on
+// success, otherwise an error is returned and none of them are pushed.
+func (q *PriorityQueue) PushBatch(items []Item) error {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries)+len(items) > constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	now := q.clock.Now()
+	for _, e := range items {
+		q.entries = append(q.entries, &priorityEntry{
+			item:       e,
+			seq:        q.seq,
+			enqueuedAt: now,
+		})
+		q.seq++
+	}
+	return nil
+}
+
+// Pop pops the next item off the queue and returns nil
+// upon success, otherwise an error is returned.
+func (q *PriorityQueue) Pop() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	i := q.next()
+	e := q.entries[i]
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	q.peeked = nil
+	return e.item, nil
+}
+
+// Peek returns the next item from the queue without
+// modifying the queue.
+func (q *PriorityQueue) Peek() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.entries) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	q.peeked = q.entries[q.next()]
+	return q.peeked.item, nil
+}
+
+// Remove removes the first item for which match returns true and returns
+// it, otherwise ErrQueueItemNotFound is returned.
+func (q *PriorityQueue) Remove(match func(Item) bool) (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	for i, e := range q.entries {
+		if !match(e.item) {
+			continue
+		}
+		q.entries = append(q.entries[:i], q.entries[i+1:]...)
+		if q.peeked == e {
+			q.peeked = nil
+		}
+		return e.item, nil
+	}
+	return nil, ErrQueueItemNotFound
+}
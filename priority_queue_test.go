@@ -0,0 +1,118 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/katzenpost/client/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	q := NewPriorityQueue(time.Hour)
+	_, err := q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+
+	low1 := &Message{QueuePriority: 0}
+	low2 := &Message{QueuePriority: 0}
+	high := &Message{QueuePriority: 5}
+	require.NoError(q.Push(low1))
+	require.NoError(q.Push(high))
+	require.NoError(q.Push(low2))
+
+	m, err := q.Peek()
+	require.NoError(err)
+	assert.True(m == high)
+
+	// Pop removes the peeked item even if a more urgent one was pushed
+	urgent := &Message{QueuePriority: 10}
+	require.NoError(q.Push(urgent))
+	m, err = q.Pop()
+	require.NoError(err)
+	assert.True(m == high)
+
+	for _, expected := range []*Message{urgent, low1, low2} {
+		m, err = q.Pop()
+		require.NoError(err)
+		assert.True(m == expected)
+	}
+	_, err = q.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+
+	for i := 0; i < constants.MaxEgressQueueSize; i++ {
+		require.NoError(q.Push(&Message{}))
+	}
+	assert.Equal(ErrQueueFull, q.Push(&Message{}))
+}
+
+func TestPriorityQueueAging(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	q := NewPriorityQueueWithClock(time.Second, clk)
+	old := &Message{QueuePriority: 0}
+	require.NoError(q.Push(old))
+	clk.Advance(3 * time.Second)
+	urgent := &Message{QueuePriority: 2}
+	require.NoError(q.Push(urgent))
+
+	// the old item aged past the urgent one
+	m, err := q.Pop()
+	require.NoError(err)
+	assert.True(m == old)
+}
+
+func TestPriorityQueueRemove(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	q := NewPriorityQueue(time.Hour)
+	low := &Message{QueuePriority: 0}
+	high := &Message{QueuePriority: 5}
+	require.NoError(q.Push(low))
+	require.NoError(q.Push(high))
+
+	m, err := q.Peek()
+	require.NoError(err)
+	require.True(m == high)
+
+	// removing the peeked item unpins it
+	m, err = q.Remove(func(i Item) bool { return i == high })
+	require.NoError(err)
+	assert.True(m == high)
+	_, err = q.Remove(func(i Item) bool { return i == high })
+	assert.Equal(ErrQueueItemNotFound, err)
+	m, err = q.Pop()
+	require.NoError(err)
+	assert.True(m == low)
+}
+
+func TestPriorityQueuePushBatch(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	q := NewPriorityQueue(time.Hour)
+	for i := 0; i < constants.MaxEgressQueueSize-1; i++ {
+		require.NoError(q.Push(&Message{}))
+	}
+	first := &Message{QueuePriority: 1}
+	second := &Message{QueuePriority: 1}
+	assert.Equal(ErrQueueFull, q.PushBatch([]Item{first, second}))
+	_, err := q.Pop()
+	require.NoError(err)
+	require.NoError(q.PushBatch([]Item{first, second}))
+
+	// the batch keeps its order
+	m, err := q.Pop()
+	require.NoError(err)
+	assert.True(m == first)
+	m, err = q.Pop()
+	require.NoError(err)
+	assert.True(m == second)
+}
@@ -29,6 +29,17 @@ var ErrQueueFull = errors.New("queue is full")
 // ErrQueueEmpty is the error issued when the queue is empty.
 var ErrQueueEmpty = errors.New("queue is empty")
 
+// ErrQueueItemNotFound is the error issued when no queued item matches.
+var ErrQueueItemNotFound = errors.New("item not found in queue")
+
+// ErrQueueNotRemovable is the error issued when the queue does not
+// implement RemovableQueue.
+var ErrQueueNotRemovable = errors.New("queue does not support removing items")
+
+// ErrQueueNotAtomic is the error issued when several items must be pushed
+// onto a queue implementing neither BatchQueue nor RemovableQueue.
+var ErrQueueNotAtomic = errors.New("queue cannot push several items atomically")
+
 // EgressQueue is the egress queue interface.
 type EgressQueue interface {
 
@@ -42,6 +53,23 @@ type EgressQueue interface {
 	Push(Item) error
 }
 
+// BatchQueue is an EgressQueue which can push several items atomically.
+type BatchQueue interface {
+	EgressQueue
+
+	// PushBatch pushes all of the items onto the queue, or none of them.
+	PushBatch([]Item) error
+}
+
+// RemovableQueue is an EgressQueue which can remove an item before it is
+// popped, as needed to cancel queued messages.
+type RemovableQueue interface {
+	EgressQueue
+
+	// Remove removes the first item for which match returns true.
+	Remove(match func(Item) bool) (Item, error)
+}
+
 // Queue is our in-memory queue implementation used as our egress FIFO queue
 // for messages sent by the client.
 type Queue struct {
@@ -66,6 +94,22 @@ func (q *Queue) Push(e Item) error {
 	return nil
 }
 
+// PushBatch pushes the given message refs onto the queue and returns nil
+// on success, otherwise an error is returned and none of them are pushed.
+func (q *Queue) PushBatch(items []Item) error {
+	q.Lock()
+	defer q.Unlock()
+	if q.len+len(items) > constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	for _, e := range items {
+		q.content[q.writeHead] = e
+		q.writeHead = (q.writeHead + 1) % constants.MaxEgressQueueSize
+		q.len++
+	}
+	return nil
+}
+
 // Pop pops the next message ref off the queue and returns nil
 // upon success, otherwise an error is returned.
 func (q *Queue) Pop() (Item, error) {
@@ -92,3 +136,28 @@ func (q *Queue) Peek() (Item, error) {
 	result := q.content[q.readHead]
 	return result, nil
 }
+
+// Remove removes the first message ref for which match returns true and
+// returns it, otherwise ErrQueueItemNotFound is returned.
+func (q *Queue) Remove(match func(Item) bool) (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	for i := 0; i < q.len; i++ {
+		idx := (q.readHead + i) % constants.MaxEgressQueueSize
+		if !match(q.content[idx]) {
+			continue
+		}
+		result := q.content[idx]
+		// shift the following items back by one
+		for j := i; j < q.len-1; j++ {
+			cur := (q.readHead + j) % constants.MaxEgressQueueSize
+			next := (q.readHead + j + 1) % constants.MaxEgressQueueSize
+			q.content[cur] = q.content[next]
+		}
+		q.writeHead = (q.writeHead - 1 + constants.MaxEgressQueueSize) % constants.MaxEgressQueueSize
+		q.content[q.writeHead] = &Message{}
+		q.len--
+		return result, nil
+	}
+	return nil, ErrQueueItemNotFound
+}
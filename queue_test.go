@@ -39,3 +39,75 @@ func TestQueue(t *testing.T) {
 	_, err = q.Pop()
 	assert.Error(err)
 }
+
+func TestQueueRemove(t *testing.T) {
+	assert := assert.New(t)
+	q := new(Queue)
+	match := func(x string) func(Item) bool {
+		return func(i Item) bool {
+			f, ok := i.(foo)
+			return ok && f.x == x
+		}
+	}
+
+	// wrap the ring around before removing
+	for i := 0; i < constants.MaxEgressQueueSize-1; i++ {
+		assert.NoError(q.Push(foo{"filler"}))
+		_, err := q.Pop()
+		assert.NoError(err)
+	}
+	for _, x := range []string{"a", "b", "c", "d"} {
+		assert.NoError(q.Push(foo{x}))
+	}
+	_, err := q.Remove(match("e"))
+	assert.Equal(ErrQueueItemNotFound, err)
+	s, err := q.Remove(match("b"))
+	assert.NoError(err)
+	assert.Equal("b", s.(foo).x)
+	assert.NoError(q.Push(foo{"e"}))
+
+	for _, x := range []string{"a", "c", "d", "e"} {
+		s, err = q.Pop()
+		assert.NoError(err)
+		assert.Equal(x, s.(foo).x)
+	}
+	_, err = q.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+}
+
+func TestQueuePushBatch(t *testing.T) {
+	assert := assert.New(t)
+	q := new(Queue)
+	for i := 0; i < constants.MaxEgressQueueSize-2; i++ {
+		assert.NoError(q.Push(foo{"filler"}))
+	}
+
+	// a batch which does not fit is rejected as a whole
+	err := q.PushBatch([]Item{foo{"a"}, foo{"b"}, foo{"c"}})
+	assert.Equal(ErrQueueFull, err)
+	assert.NoError(q.PushBatch([]Item{foo{"a"}, foo{"b"}}))
+	assert.Equal(ErrQueueFull, q.Push(foo{"c"}))
+
+	for i := 0; i < constants.MaxEgressQueueSize-2; i++ {
+		_, err = q.Pop()
+		assert.NoError(err)
+	}
+	for _, x := range []string{"a", "b"} {
+		s, err := q.Pop()
+		assert.NoError(err)
+		assert.Equal(x, s.(foo).x)
+	}
+}
+
+func TestCancelMessageNotRemovable(t *testing.T) {
+	var _ RemovableQueue = new(Queue)
+	var _ RemovableQueue = new(PriorityQueue)
+	var _ RemovableQueue = new(PersistentQueue)
+
+	// a third party queue only implementing EgressQueue
+	s := &Session{
+		egressQueue: struct{ EgressQueue }{new(Queue)},
+	}
+	err := s.CancelMessage(new([constants.MessageIDLength]byte))
+	assert.Equal(t, ErrQueueNotRemovable, err)
+}
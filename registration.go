@@ -0,0 +1,541 @@
+// registration.go - Provider account registration.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	kpki "github.com/hashcloak/Meson-client/pkiclient"
+	"github.com/hashcloak/Meson-client/pkiclient/epochtime"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	registration "github.com/katzenpost/registration_client"
+)
+
+const (
+	initialPKIConsensusTimeout = 10 * time.Second
+
+	defaultRegisterMaxAttempts   = 3
+	defaultRegisterRetryDelay    = 2 * time.Second
+	defaultRegisterMaxRetryDelay = 30 * time.Second
+)
+
+// ErrNoRegistrationProviders is the error returned when the consensus lists
+// no Provider accepting registrations.
+var ErrNoRegistrationProviders = errors.New("registration: zero registration Providers found in the consensus")
+
+// ErrNoRegistrationAddress is the error returned when a Provider lists no
+// usable registration address.
+var ErrNoRegistrationAddress = errors.New("registration: no usable registration address")
+
+// ConsensusError is the error returned when the PKI consensus document
+// needed to pick a registration Provider could not be retrieved.
+type ConsensusError struct {
+	// Err is the original error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ConsensusError) Error() string {
+	return fmt.Sprintf("registration: failed to retrieve consensus: %v", e.Err)
+}
+
+// Unwrap returns the original error.
+func (e *ConsensusError) Unwrap() error {
+	return e.Err
+}
+
+// RegistrationError is the error returned when every registration endpoint
+// failed.  It describes the last endpoint that was tried.
+type RegistrationError struct {
+	// Provider is the name of the last Provider tried.
+	Provider string
+
+	// Address is the last registration address tried.
+	Address string
+
+	// Attempts is the total number of registration attempts made.
+	Attempts int
+
+	// Err is the error returned by the last attempt.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *RegistrationError) Error() string {
+	return fmt.Sprintf("registration: failed after %d attempts, last with %v at %v: %v", e.Attempts, e.Provider, e.Address, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *RegistrationError) Unwrap() error {
+	return e.Err
+}
+
+// RegisterOptions are the optional parameters of Register.
+type RegisterOptions struct {
+	// LinkKey is the link key to register, a new one is generated if nil.
+	LinkKey *ecdh.PrivateKey
+
+	// User is the account name to register.  If empty, it is derived
+	// from the link key.
+	User string
+
+	// PKIClient is used to retrieve the consensus document.  If nil, a
+	// PKI client is created from the configuration for the duration of
+	// the call.
+	PKIClient kpki.Client
+
+	// MaxAttempts is the number of passes made over all registration
+	// endpoints before giving up.
+	MaxAttempts int
+
+	// RetryDelay is the delay before the second pass, doubled after each
+	// further pass up to MaxRetryDelay.
+	RetryDelay time.Duration
+
+	// MaxRetryDelay is the upper bound of the delay between passes.
+	MaxRetryDelay time.Duration
+
+	// Clock is the optional source of time of the delays between passes,
+	// the system clock is used if left unset.
+	Clock clock.Clock
+
+	// Rand is the optional source of randomness of the Provider order, a
+	// new rand.NewMath instance is used if left unset.
+	Rand *mrand.Rand
+}
+
+func (o *RegisterOptions) fixup() {
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = defaultRegisterMaxAttempts
+	}
+	if o.RetryDelay <= 0 {
+		o.RetryDelay = defaultRegisterRetryDelay
+	}
+	if o.MaxRetryDelay <= 0 {
+		o.MaxRetryDelay = defaultRegisterMaxRetryDelay
+	}
+	if o.Clock == nil {
+		o.Clock = clock.Real
+	}
+	if o.Rand == nil {
+		o.Rand = rand.NewMath()
+	}
+}
+
+// selectRegistrationProviders returns the registration capable Providers of
+// doc permitted by the selection policy, in random order except that the
+// Providers advertising the policy's preferred service come first.
+func selectRegistrationProviders(doc *pki.Document, selection *config.ProviderSelection, mRng *mrand.Rand) []*pki.MixDescriptor {
+	preferred := []*pki.MixDescriptor{}
+	others := []*pki.MixDescriptor{}
+	for _, provider := range doc.Providers {
+		if len(provider.RegistrationHTTPAddresses) == 0 {
+			continue
+		}
+		if selection == nil {
+			others = append(others, provider)
+			continue
+		}
+		if !selection.Permits(provider.Name) {
+			continue
+		}
+		if _, ok := provider.Kaetzchen[selection.PreferService]; ok && selection.PreferService != "" {
+			preferred = append(preferred, provider)
+		} else {
+			others = append(others, provider)
+		}
+	}
+	shuffle := func(providers []*pki.MixDescriptor) {
+		mRng.Shuffle(len(providers), func(i, j int) {
+			providers[i], providers[j] = providers[j], providers[i]
+		})
+	}
+	shuffle(preferred)
+	shuffle(others)
+	return append(preferred, others...)
+}
+
+// registrationEndpoint is a single registration address of a Provider.
+type registrationEndpoint struct {
+	provider *pki.MixDescriptor
+	address  string
+}
+
+// registrationEndpoints returns the registration endpoints of the given
+// Providers, trying the first address of every Provider before falling
+// back to their next addresses.
+func registrationEndpoints(providers []*pki.MixDescriptor) []registrationEndpoint {
+	endpoints := []registrationEndpoint{}
+	for i := 0; ; i++ {
+		found := false
+		for _, provider := range providers {
+			if i < len(provider.RegistrationHTTPAddresses) {
+				endpoints = append(endpoints, registrationEndpoint{
+					provider: provider,
+					address:  provider.RegistrationHTTPAddresses[i],
+				})
+				found = true
+			}
+		}
+		if !found {
+			return endpoints
+		}
+	}
+}
+
+// fetchCurrentDocument retrieves a copy of the PKI consensus document
+// for the current epoch.  If pkiClient is nil a temporary one is created.
+func fetchCurrentDocument(ctx context.Context, cfg *config.Config, pkiClient kpki.Client) (*pki.Document, error) {
+	if pkiClient == nil {
+		logFile, err := ioutil.TempFile("", "meson-client-registration-log")
+		if err != nil {
+			return nil, &ConsensusError{Err: err}
+		}
+		defer os.Remove(logFile.Name())
+		backendLog, err := log.New(logFile.Name(), "ERROR", false)
+		if err != nil {
+			return nil, &ConsensusError{Err: err}
+		}
+		proxyCfg := cfg.UpstreamProxyConfig()
+		pkiClient, err = cfg.NewPKIClient(backendLog, proxyCfg)
+		if err != nil {
+			return nil, &ConsensusError{Err: err}
+		}
+		// have to shutdown pkiclient and release database
+		// maybe find better solution?
+		defer pkiClient.Shutdown()
+	}
+	currentEpoch, _, _, err := epochtime.Now(pkiClient)
+	if err != nil {
+		return nil, &ConsensusError{Err: err}
+	}
+	ctx, cancel := context.WithTimeout(ctx, initialPKIConsensusTimeout)
+	defer cancel()
+	doc, _, err := pkiClient.GetDoc(ctx, currentEpoch)
+	if err != nil {
+		return nil, &ConsensusError{Err: err}
+	}
+	return doc, nil
+}
+
+// registrationConfig returns the registration configuration of a
+// registration address, keeping the Provider selection policy of cfg.
+func registrationConfig(cfg *config.Config, address string) (*config.Registration, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	cfgRegistration := &config.Registration{
+		Address: u.Host,
+		Options: &registration.Options{
+			Scheme:       u.Scheme,
+			UseSocks:     strings.HasPrefix(cfg.UpstreamProxy.Type, "socks"),
+			SocksNetwork: cfg.UpstreamProxy.Network,
+			SocksAddress: cfg.UpstreamProxy.Address,
+		},
+	}
+	if cfg.Registration != nil {
+		cfgRegistration.Selection = cfg.Registration.Selection
+	}
+	return cfgRegistration, nil
+}
+
+// registerFn registers the user and link key with a registration endpoint.
+type registerFn func(cfgRegistration *config.Registration, user string, linkKey *ecdh.PublicKey) error
+
+func registerWithEndpoint(cfgRegistration *config.Registration, user string, linkKey *ecdh.PublicKey) error {
+	client, err := registration.New(cfgRegistration.Address, cfgRegistration.Options)
+	if err != nil {
+		return err
+	}
+	return client.RegisterAccountWithLinkKey(user, linkKey)
+}
+
+// registerAt registers the user and link key at a single registration
+// endpoint and returns the matching account and registration configuration.
+func registerAt(cfg *config.Config, endpoint registrationEndpoint, user string, linkKey *ecdh.PublicKey) (*config.Account, *config.Registration, error) {
+	cfgRegistration, err := registrationConfig(cfg, endpoint.address)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = registerWithEndpoint(cfgRegistration, user, linkKey); err != nil {
+		return nil, nil, err
+	}
+	account := &config.Account{
+		User:           user,
+		Provider:       endpoint.provider.Name,
+		ProviderKeyPin: endpoint.provider.IdentityKey,
+	}
+	return account, cfgRegistration, nil
+}
+
+// Register registers a client account with a Provider picked from the
+// current consensus according to the cfg.Registration.Selection policy, and
+// on success updates the Account and Registration sections of cfg and
+// returns the registered link key.  When a registration endpoint fails, the
+// next registration capable Provider is tried, then the next address of
+// every Provider, for up to opts.MaxAttempts passes.
+func Register(ctx context.Context, cfg *config.Config, opts *RegisterOptions) (*ecdh.PrivateKey, error) {
+	if opts == nil {
+		opts = new(RegisterOptions)
+	}
+	o := *opts
+	o.fixup()
+
+	linkKey := o.LinkKey
+	if linkKey == nil {
+		var err error
+		linkKey, err = ecdh.NewKeypair(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+	}
+	user := o.User
+	if user == "" {
+		user = fmt.Sprintf("%x", linkKey.PublicKey().Bytes())
+	}
+
+	// Retrieve a copy of the PKI consensus document.
+	doc, err := fetchCurrentDocument(ctx, cfg, o.PKIClient)
+	if err != nil {
+		return nil, err
+	}
+
+	var selection *config.ProviderSelection
+	if cfg.Registration != nil {
+		selection = cfg.Registration.Selection
+	}
+	registerProviders := selectRegistrationProviders(doc, selection, o.Rand)
+	if len(registerProviders) == 0 {
+		return nil, ErrNoRegistrationProviders
+	}
+	endpoints := registrationEndpoints(registerProviders)
+
+	regErr := new(RegistrationError)
+	delay := o.RetryDelay
+	for pass := 0; pass < o.MaxAttempts; pass++ {
+		if pass > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-o.Clock.After(delay):
+			}
+			delay *= 2
+			if delay > o.MaxRetryDelay {
+				delay = o.MaxRetryDelay
+			}
+		}
+		for _, endpoint := range endpoints {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			account, cfgRegistration, err := registerAt(cfg, endpoint, user, linkKey.PublicKey())
+			regErr.Attempts++
+			if err == nil {
+				cfg.Account = account
+				cfg.Registration = cfgRegistration
+				return linkKey, nil
+			}
+			regErr.Provider = endpoint.provider.Name
+			regErr.Address = endpoint.address
+			regErr.Err = err
+		}
+	}
+	return nil, regErr
+}
+
+// RegisterClient registers the configured account with the configured
+// registration endpoint.
+func RegisterClient(cfg *config.Config, linkKey *ecdh.PublicKey) error {
+	client, err := registration.New(cfg.Registration.Address, cfg.Registration.Options)
+	if err != nil {
+		return err
+	}
+	err = client.RegisterAccountWithLinkKey(cfg.Account.User, linkKey)
+	return err
+}
+
+// AutoRegisterRandomClient registers a new random client account with a
+// Provider picked from the consensus and panics on failure.  Long running
+// applications should use Register instead.
+func AutoRegisterRandomClient(cfg *config.Config) *ecdh.PrivateKey {
+	linkKey, err := Register(context.Background(), cfg, nil)
+	if err != nil {
+		panic(err)
+	}
+	return linkKey
+}
+
+// isAccountKnown returns true iff the account's Provider is still listed in
+// doc, still uses the pinned identity key if one is set, and is permitted
+// by the Provider selection policy.
+func isAccountKnown(cfg *config.Config, doc *pki.Document, account *config.Account) bool {
+	if !cfg.Registration.PermitsProvider(account.Provider) {
+		return false
+	}
+	provider, err := doc.GetProvider(account.Provider)
+	if err != nil {
+		return false
+	}
+	if account.ProviderKeyPin != nil && !account.ProviderKeyPin.Equal(provider.IdentityKey) {
+		return false
+	}
+	return true
+}
+
+// providerRegistration returns the registration configuration of the first
+// usable registration address of provider, without contacting it.
+func providerRegistration(cfg *config.Config, provider *pki.MixDescriptor) (*config.Registration, error) {
+	for _, address := range provider.RegistrationHTTPAddresses {
+		if cfgRegistration, err := registrationConfig(cfg, address); err == nil {
+			return cfgRegistration, nil
+		}
+	}
+	return nil, ErrNoRegistrationAddress
+}
+
+// restoreAccount registers the stored account again with its Provider and
+// returns the registration configuration of the address that accepted it.
+// Only an address that cannot be reached is skipped in favour of the next
+// one, any other failure such as the Provider refusing the account is
+// returned as is.
+func restoreAccount(cfg *config.Config, provider *pki.MixDescriptor, id *Identity, register registerFn) (*config.Registration, error) {
+	regErr := &RegistrationError{Provider: provider.Name}
+	for _, address := range provider.RegistrationHTTPAddresses {
+		cfgRegistration, err := registrationConfig(cfg, address)
+		if err != nil {
+			continue
+		}
+		regErr.Attempts++
+		regErr.Address = address
+		if regErr.Err = register(cfgRegistration, id.Account.User, id.LinkKey.PublicKey()); regErr.Err == nil {
+			return cfgRegistration, nil
+		}
+		var netErr net.Error
+		if !errors.As(regErr.Err, &netErr) {
+			break
+		}
+	}
+	if regErr.Attempts == 0 {
+		return nil, ErrNoRegistrationAddress
+	}
+	return nil, regErr
+}
+
+// RestoreAccount registers the account of cfg with its Provider again under
+// linkKey, and on success sets cfg.Registration to the address that accepted
+// it.  It is meant for a Provider that lost the account and therefore fails
+// the link authentication, as the stored account is otherwise never
+// registered twice.
+func RestoreAccount(cfg *config.Config, linkKey *ecdh.PrivateKey) error {
+	doc, err := fetchCurrentDocument(context.Background(), cfg, nil)
+	if err != nil {
+		return err
+	}
+	provider, err := doc.GetProvider(cfg.Account.Provider)
+	if err != nil {
+		return err
+	}
+	id := &Identity{
+		LinkKey: linkKey,
+		Account: cfg.Account,
+	}
+	cfgRegistration, err := restoreAccount(cfg, provider, id, registerWithEndpoint)
+	if err != nil {
+		return err
+	}
+	cfg.Registration = cfgRegistration
+	return nil
+}
+
+// LoadOrRegisterClient returns the link key of the identity stored in the
+// keystore configured by cfg.Keystore and sets cfg.Account to the stored
+// account and cfg.Registration to its Provider's.  A new identity is
+// registered and saved when the keystore does not exist yet.  The stored
+// account is only registered again, with another Provider, when its Provider
+// no longer appears in the consensus or is no longer permitted by the
+// Provider selection policy.  See RestoreAccount for a Provider that lost
+// the account.
+// Without a Keystore section a new random account is registered every time.
+func LoadOrRegisterClient(cfg *config.Config) (*ecdh.PrivateKey, error) {
+	ctx := context.Background()
+	if cfg.Keystore == nil {
+		return Register(ctx, cfg, nil)
+	}
+	id, err := LoadIdentity(cfg.Keystore.File, cfg.Keystore.Passphrase)
+	switch err {
+	case nil:
+	case ErrKeystoreNotFound:
+		linkKey, err := Register(ctx, cfg, nil)
+		if err != nil {
+			return nil, err
+		}
+		id = &Identity{
+			LinkKey: linkKey,
+			Account: cfg.Account,
+		}
+		if err = SaveIdentity(cfg.Keystore.File, cfg.Keystore.Passphrase, id); err != nil {
+			return nil, err
+		}
+		return linkKey, nil
+	default:
+		return nil, err
+	}
+
+	doc, err := fetchCurrentDocument(ctx, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	if isAccountKnown(cfg, doc, id.Account) {
+		provider, _ := doc.GetProvider(id.Account.Provider)
+		// Keep the configured section when the Provider lists no
+		// usable registration address.
+		if cfgRegistration, err := providerRegistration(cfg, provider); err == nil {
+			cfg.Registration = cfgRegistration
+		}
+		cfg.Account = id.Account
+		return id.LinkKey, nil
+	}
+
+	// Our Provider is gone, register the same identity elsewhere.
+	_, err = Register(ctx, cfg, &RegisterOptions{
+		LinkKey: id.LinkKey,
+		User:    id.Account.User,
+	})
+	if err != nil {
+		return nil, err
+	}
+	id.Account = cfg.Account
+	if err = SaveIdentity(cfg.Keystore.File, cfg.Keystore.Passphrase, id); err != nil {
+		return nil, err
+	}
+	return id.LinkKey, nil
+}
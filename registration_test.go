@@ -0,0 +1,147 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrationEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	providers := []*pki.MixDescriptor{
+		{
+			Name:                      "provider1",
+			RegistrationHTTPAddresses: []string{"http://1.1.1.1:8080", "http://1.1.1.2:8080"},
+		},
+		{
+			Name:                      "provider2",
+			RegistrationHTTPAddresses: []string{"http://2.2.2.2:8080"},
+		},
+	}
+	endpoints := registrationEndpoints(providers)
+	assert.Len(endpoints, 3)
+	assert.Equal("provider1", endpoints[0].provider.Name)
+	assert.Equal("http://1.1.1.1:8080", endpoints[0].address)
+	assert.Equal("provider2", endpoints[1].provider.Name)
+	assert.Equal("http://2.2.2.2:8080", endpoints[1].address)
+	assert.Equal("provider1", endpoints[2].provider.Name)
+	assert.Equal("http://1.1.1.2:8080", endpoints[2].address)
+
+	assert.Empty(registrationEndpoints(nil))
+}
+
+func TestSelectRegistrationProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := &pki.Document{
+		Providers: []*pki.MixDescriptor{
+			{
+				Name:                      "provider1",
+				RegistrationHTTPAddresses: []string{"http://1.1.1.1:8080"},
+			},
+			{
+				Name:                      "provider2",
+				RegistrationHTTPAddresses: []string{"http://2.2.2.2:8080"},
+				Kaetzchen: map[string]map[string]interface{}{
+					"gor": {},
+				},
+			},
+			{
+				Name:                      "provider3",
+				RegistrationHTTPAddresses: []string{"http://3.3.3.3:8080"},
+			},
+			{
+				Name: "provider4",
+			},
+		},
+	}
+	mRng := rand.NewMath()
+
+	providers := selectRegistrationProviders(doc, nil, mRng)
+	assert.Len(providers, 3)
+
+	providers = selectRegistrationProviders(doc, &config.ProviderSelection{PreferService: "gor"}, mRng)
+	assert.Len(providers, 3)
+	assert.Equal("provider2", providers[0].Name)
+
+	providers = selectRegistrationProviders(doc, &config.ProviderSelection{Deny: []string{"provider2", "provider3"}}, mRng)
+	assert.Len(providers, 1)
+	assert.Equal("provider1", providers[0].Name)
+
+	providers = selectRegistrationProviders(doc, &config.ProviderSelection{Allow: []string{"provider3", "provider4"}}, mRng)
+	assert.Len(providers, 1)
+	assert.Equal("provider3", providers[0].Name)
+
+	providers = selectRegistrationProviders(doc, &config.ProviderSelection{Provider: "provider4"}, mRng)
+	assert.Empty(providers)
+}
+
+func TestRestoreAccount(t *testing.T) {
+	assert := assert.New(t)
+
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	assert.NoError(err)
+	id := &Identity{
+		LinkKey: linkKey,
+		Account: &config.Account{User: "alice", Provider: "provider1"},
+	}
+	cfg := &config.Config{
+		UpstreamProxy: &config.UpstreamProxy{Type: "none"},
+		Registration: &config.Registration{
+			Selection: &config.ProviderSelection{Deny: []string{"provider2"}},
+		},
+	}
+	provider := &pki.MixDescriptor{
+		Name:                      "provider1",
+		RegistrationHTTPAddresses: []string{"http://1.1.1.1:8080", "https://1.1.1.2:8080"},
+	}
+
+	r, err := providerRegistration(cfg, provider)
+	assert.NoError(err)
+	assert.Equal("1.1.1.1:8080", r.Address)
+	_, err = providerRegistration(cfg, &pki.MixDescriptor{Name: "provider1"})
+	assert.Equal(ErrNoRegistrationAddress, err)
+
+	// the first address is unreachable, the second one restores the account
+	addresses := []string{}
+	register := func(r *config.Registration, user string, key *ecdh.PublicKey) error {
+		assert.Equal("alice", user)
+		assert.Equal(linkKey.PublicKey().Bytes(), key.Bytes())
+		addresses = append(addresses, r.Address)
+		if len(addresses) == 1 {
+			return &net.OpError{Op: "dial", Err: errors.New("unreachable")}
+		}
+		return nil
+	}
+	r, err = restoreAccount(cfg, provider, id, register)
+	assert.NoError(err)
+	assert.Equal([]string{"1.1.1.1:8080", "1.1.1.2:8080"}, addresses)
+	assert.Equal("1.1.1.2:8080", r.Address)
+	assert.Equal("https", r.Options.Scheme)
+	assert.Equal(cfg.Registration.Selection, r.Selection)
+
+	// a refusal is returned without trying the next address
+	attempts := 0
+	refused := errors.New("user already exists")
+	refuse := func(*config.Registration, string, *ecdh.PublicKey) error {
+		attempts++
+		return refused
+	}
+	r, err = restoreAccount(cfg, provider, id, refuse)
+	assert.Nil(r)
+	assert.Equal(1, attempts)
+	assert.True(errors.Is(err, refused))
+	var regErr *RegistrationError
+	assert.True(errors.As(err, &regErr))
+	assert.Equal("http://1.1.1.1:8080", regErr.Address)
+
+	_, err = restoreAccount(cfg, &pki.MixDescriptor{Name: "provider1"}, id, refuse)
+	assert.Equal(ErrNoRegistrationAddress, err)
+}
@@ -0,0 +1,176 @@
+// rpc.go - Typed Kaetzchen RPC client.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package rpc provides a typed client for the Kaetzchen services reached
+// through a client Session, encoding requests and decoding responses with
+// a Codec.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/client/utils"
+)
+
+// ErrMalformedReply is the error issued when a reply is not length
+// prefixed as expected.
+var ErrMalformedReply = errors.New("rpc: malformed reply")
+
+// Transport sends requests to services, it is implemented by
+// *client.Session.
+type Transport interface {
+	// GetService returns a randomly selected service matching the
+	// service name.
+	GetService(serviceName string) (*utils.ServiceDescriptor, error)
+
+	// SendAndWait sends a message and blocks until the reply is received.
+	SendAndWait(ctx context.Context, recipient, provider string, message []byte) ([]byte, error)
+
+	// SendUnreliableMessageWithReplyCheck asynchronously sends a message,
+	// validating its reply with check.
+	SendUnreliableMessageWithReplyCheck(recipient, provider string, message []byte, check func(reply []byte) error) (*[constants.MessageIDLength]byte, error)
+}
+
+// StatusReply is implemented by responses carrying a service level status.
+type StatusReply interface {
+	// Status returns the status code, zero on success, and the message
+	// describing it.
+	Status() (code int, message string)
+}
+
+// Response is the common response of the Meson services.
+type Response struct {
+	Version    int
+	StatusCode int
+	Message    string
+}
+
+// Status implements StatusReply.
+func (r *Response) Status() (int, string) {
+	return r.StatusCode, r.Message
+}
+
+// ServiceError is the error issued when a service replied with an error
+// status.
+type ServiceError struct {
+	// Service is the name of the service.
+	Service string
+
+	// Code is the status code of the reply.
+	Code int
+
+	// Message is the message describing the error.
+	Message string
+}
+
+// Error implements error.
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("rpc: service %v error %d: %v", e.Service, e.Code, e.Message)
+}
+
+// Client calls services with requests encoded by its Codec.
+type Client struct {
+	transport Transport
+	codec     Codec
+}
+
+// NewClient returns a Client sending requests through transport. JSON is
+// used if codec is nil.
+func NewClient(transport Transport, codec Codec) *Client {
+	if codec == nil {
+		codec = JSON
+	}
+	return &Client{
+		transport: transport,
+		codec:     codec,
+	}
+}
+
+// Call sends request to the named service and decodes the reply into
+// response, blocking until the reply is received or the context is done.
+// A *ServiceError is returned if response is a StatusReply with an error
+// status.
+func (c *Client) Call(ctx context.Context, service string, request, response interface{}) error {
+	desc, err := c.transport.GetService(service)
+	if err != nil {
+		return err
+	}
+	payload, err := c.codec.Marshal(request)
+	if err != nil {
+		return err
+	}
+	reply, err := c.transport.SendAndWait(ctx, desc.Name, desc.Provider, payload)
+	if err != nil {
+		return err
+	}
+	return c.DecodeReply(service, reply, response)
+}
+
+// Go asynchronously sends request to the named service.  The reply is
+// delivered as a MessageReplyEvent whose Err is set by decoding it into a
+// response returned by newResponse, the payload may be decoded again
+// with DecodeReply.
+func (c *Client) Go(service string, request interface{}, newResponse func() interface{}) (*[constants.MessageIDLength]byte, error) {
+	desc, err := c.transport.GetService(service)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.codec.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	check := func(reply []byte) error {
+		return c.DecodeReply(service, reply, newResponse())
+	}
+	return c.transport.SendUnreliableMessageWithReplyCheck(desc.Name, desc.Provider, payload, check)
+}
+
+// DecodeReply decodes the reply of the named service into response.
+func (c *Client) DecodeReply(service string, reply []byte, response interface{}) error {
+	body, err := unframe(reply)
+	if err != nil {
+		return err
+	}
+	if err = c.codec.Unmarshal(body, response); err != nil {
+		return fmt.Errorf("rpc: failed to decode %v reply: %v", c.codec.Name(), err)
+	}
+	if status, ok := response.(StatusReply); ok {
+		if code, message := status.Status(); code != 0 {
+			return &ServiceError{
+				Service: service,
+				Code:    code,
+				Message: message,
+			}
+		}
+	}
+	return nil
+}
+
+// unframe strips the length prefix and the padding of a reply.
+func unframe(reply []byte) ([]byte, error) {
+	if len(reply) < 4 {
+		return nil, ErrMalformedReply
+	}
+	n := binary.BigEndian.Uint32(reply[:4])
+	if uint64(n) > uint64(len(reply)-4) {
+		return nil, ErrMalformedReply
+	}
+	return reply[4 : 4+n], nil
+}
@@ -0,0 +1,118 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/client/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type echoRequest struct {
+	Version int
+	Text    string
+}
+
+type echoResponse struct {
+	Response
+	Text string
+}
+
+// fakeTransport replies to every request with the reply function.
+type fakeTransport struct {
+	codec Codec
+	reply func(request []byte) []byte
+	check func(reply []byte) error
+}
+
+func (t *fakeTransport) GetService(serviceName string) (*utils.ServiceDescriptor, error) {
+	if serviceName != "echo" {
+		return nil, errors.New("service not found")
+	}
+	return &utils.ServiceDescriptor{Name: "+echo", Provider: "provider1"}, nil
+}
+
+func (t *fakeTransport) SendAndWait(ctx context.Context, recipient, provider string, message []byte) ([]byte, error) {
+	return t.reply(message), nil
+}
+
+func (t *fakeTransport) SendUnreliableMessageWithReplyCheck(recipient, provider string, message []byte, check func(reply []byte) error) (*[constants.MessageIDLength]byte, error) {
+	t.check = check
+	return new([constants.MessageIDLength]byte), nil
+}
+
+func frame(b []byte) []byte {
+	// length prefixed and padded like a Kaetzchen reply
+	reply := make([]byte, 4+len(b)+32)
+	binary.BigEndian.PutUint32(reply, uint32(len(b)))
+	copy(reply[4:], b)
+	return reply
+}
+
+func newEchoTransport(codec Codec, statusCode int) *fakeTransport {
+	t := &fakeTransport{codec: codec}
+	t.reply = func(request []byte) []byte {
+		req := new(echoRequest)
+		if err := codec.Unmarshal(request, req); err != nil {
+			panic(err)
+		}
+		resp := &echoResponse{Text: req.Text}
+		resp.StatusCode = statusCode
+		if statusCode != 0 {
+			resp.Message = "echo failure"
+		}
+		raw, err := codec.Marshal(resp)
+		if err != nil {
+			panic(err)
+		}
+		return frame(raw)
+	}
+	return t
+}
+
+func TestCall(t *testing.T) {
+	for _, codec := range []Codec{JSON, CBOR} {
+		require := require.New(t)
+		assert := assert.New(t)
+
+		c := NewClient(newEchoTransport(codec, 0), codec)
+		resp := new(echoResponse)
+		err := c.Call(context.Background(), "echo", &echoRequest{Text: "hello"}, resp)
+		require.NoError(err, codec.Name())
+		assert.Equal("hello", resp.Text)
+
+		err = c.Call(context.Background(), "nope", &echoRequest{}, resp)
+		assert.Error(err)
+
+		c = NewClient(newEchoTransport(codec, 3), codec)
+		err = c.Call(context.Background(), "echo", &echoRequest{Text: "hello"}, resp)
+		serviceErr, ok := err.(*ServiceError)
+		require.True(ok, codec.Name())
+		assert.Equal("echo", serviceErr.Service)
+		assert.Equal(3, serviceErr.Code)
+		assert.Equal("echo failure", serviceErr.Message)
+	}
+}
+
+func TestGo(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	transport := newEchoTransport(JSON, 2)
+	c := NewClient(transport, nil)
+	_, err := c.Go("echo", &echoRequest{Text: "hello"}, func() interface{} { return new(echoResponse) })
+	require.NoError(err)
+	require.NotNil(transport.check)
+
+	raw, err := JSON.Marshal(&echoRequest{Text: "hello"})
+	require.NoError(err)
+	err = transport.check(transport.reply(raw))
+	_, ok := err.(*ServiceError)
+	assert.True(ok)
+
+	assert.Equal(ErrMalformedReply, transport.check([]byte{0, 0, 1, 0}))
+}
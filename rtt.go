@@ -0,0 +1,148 @@
+// rtt.go - Adaptive round trip time estimation.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"sync"
+	"time"
+
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+const (
+	// rttAlpha and rttBeta are the smoothing factors of RFC 6298 as
+	// inverse fractions, ie 1/8 and 1/4.
+	rttAlpha = 8
+	rttBeta  = 4
+
+	// rttVarianceFactor is the K factor of RFC 6298.
+	rttVarianceFactor = 4
+
+	// maxReplySlop bounds the estimated delay of a reply beyond its
+	// ReplyETA, so that a few outliers cannot hold SURBs forever.
+	maxReplySlop = 10 * time.Minute
+)
+
+// RTTEstimate is the round trip time estimate of a service.  The Sphinx
+// delays of each message are sampled at random and accounted for by its
+// ReplyETA, so the estimate is of the delay of the replies beyond their
+// ReplyETA: the Provider, network and service processing latency.
+type RTTEstimate struct {
+	// SRTT is the smoothed delay of the replies beyond their ReplyETA.
+	SRTT time.Duration
+
+	// RTTVar is the variation of the delay of the replies.
+	RTTVar time.Duration
+
+	// Samples is the number of replies the estimate is based on.
+	Samples int
+}
+
+// Slop returns how long to wait for a reply beyond its ReplyETA, which is
+// never less than RoundTripTimeSlop.
+func (e *RTTEstimate) Slop() time.Duration {
+	if e == nil || e.Samples == 0 {
+		return cConstants.RoundTripTimeSlop
+	}
+	slop := e.SRTT + rttVarianceFactor*e.RTTVar
+	if slop < cConstants.RoundTripTimeSlop {
+		return cConstants.RoundTripTimeSlop
+	}
+	if slop > maxReplySlop {
+		return maxReplySlop
+	}
+	return slop
+}
+
+func (e *RTTEstimate) observe(sample time.Duration) {
+	if sample < 0 {
+		sample = 0
+	}
+	if e.Samples == 0 {
+		e.SRTT = sample
+		e.RTTVar = sample / 2
+	} else {
+		delta := e.SRTT - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		e.RTTVar += (delta - e.RTTVar) / rttBeta
+		e.SRTT += (sample - e.SRTT) / rttAlpha
+	}
+	e.Samples++
+}
+
+type rttKey struct {
+	recipient string
+	provider  string
+}
+
+// rttTable keeps a round trip time estimate per service.
+type rttTable struct {
+	sync.Mutex
+	estimates map[rttKey]*RTTEstimate
+}
+
+func newRTTTable() *rttTable {
+	return &rttTable{
+		estimates: make(map[rttKey]*RTTEstimate),
+	}
+}
+
+// observe records the reply to msg received at repliedAt.
+func (t *rttTable) observe(msg *Message, repliedAt time.Time) {
+	if msg.SentAt.IsZero() {
+		return
+	}
+	key := rttKey{msg.Recipient, msg.Provider}
+	t.Lock()
+	defer t.Unlock()
+	e, ok := t.estimates[key]
+	if !ok {
+		e = new(RTTEstimate)
+		t.estimates[key] = e
+	}
+	e.observe(repliedAt.Sub(msg.SentAt) - msg.ReplyETA)
+}
+
+func (t *rttTable) get(recipient, provider string) (*RTTEstimate, bool) {
+	t.Lock()
+	defer t.Unlock()
+	e, ok := t.estimates[rttKey{recipient, provider}]
+	if !ok {
+		return nil, false
+	}
+	copied := *e
+	return &copied, true
+}
+
+// slop returns how long to wait for a reply to msg beyond its ReplyETA.
+func (t *rttTable) slop(msg *Message) time.Duration {
+	e, _ := t.get(msg.Recipient, msg.Provider)
+	return e.Slop()
+}
+
+// replyTimeout returns how long to wait for a reply to msg once sent.
+func (s *Session) replyTimeout(msg *Message) time.Duration {
+	return msg.ReplyETA + s.rtts.slop(msg)
+}
+
+// RTTEstimate returns the round trip time estimate of the service
+// recipient on provider, or false if no reply was received from it yet.
+func (s *Session) RTTEstimate(recipient, provider string) (*RTTEstimate, bool) {
+	return s.rtts.get(recipient, provider)
+}
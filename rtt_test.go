@@ -0,0 +1,69 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTTEstimate(t *testing.T) {
+	assert := assert.New(t)
+
+	e := new(RTTEstimate)
+	assert.Equal(cConstants.RoundTripTimeSlop, e.Slop())
+
+	// RFC 6298 initialization and update
+	e.observe(80 * time.Second)
+	assert.Equal(80*time.Second, e.SRTT)
+	assert.Equal(40*time.Second, e.RTTVar)
+	e.observe(40 * time.Second)
+	assert.Equal(75*time.Second, e.SRTT)
+	assert.Equal(40*time.Second, e.RTTVar)
+	assert.Equal(235*time.Second, e.Slop())
+
+	// fast services keep the minimum slop
+	e = new(RTTEstimate)
+	for i := 0; i < 8; i++ {
+		e.observe(-time.Second)
+	}
+	assert.Equal(time.Duration(0), e.SRTT)
+	assert.Equal(cConstants.RoundTripTimeSlop, e.Slop())
+
+	// outliers are bounded
+	e.observe(time.Hour)
+	assert.Equal(maxReplySlop, e.Slop())
+}
+
+func TestRTTTable(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	table := newRTTTable()
+	now := time.Now()
+	msg := &Message{
+		Recipient: "echo",
+		Provider:  "provider",
+		SentAt:    now.Add(-90 * time.Second),
+		ReplyETA:  30 * time.Second,
+	}
+	table.observe(msg, now)
+	e, ok := table.get("echo", "provider")
+	require.True(ok)
+	assert.Equal(1, e.Samples)
+	assert.Equal(time.Minute, e.SRTT)
+	assert.Equal(3*time.Minute, table.slop(msg))
+
+	// estimates are kept per service
+	_, ok = table.get("echo", "other")
+	assert.False(ok)
+	other := &Message{Recipient: "echo", Provider: "other", ReplyETA: time.Second}
+	assert.Equal(cConstants.RoundTripTimeSlop, table.slop(other))
+
+	// unsent messages are ignored
+	table.observe(&Message{Recipient: "echo", Provider: "provider"}, now)
+	e, _ = table.get("echo", "provider")
+	assert.Equal(1, e.Samples)
+}
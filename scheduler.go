@@ -0,0 +1,197 @@
+// scheduler.go - Cover traffic scheduling.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	cRand "github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/pki"
+)
+
+// TrafficKind is the kind of traffic sent when a traffic timer fires.
+type TrafficKind int
+
+const (
+	// TrafficSend sends the next queued message, or a drop decoy if the
+	// egress queue is empty.  It is scheduled after LambdaP.
+	TrafficSend TrafficKind = iota
+
+	// TrafficLoopDecoy sends a loop decoy.  It is scheduled after LambdaL.
+	TrafficLoopDecoy
+
+	// TrafficDropDecoy sends a drop decoy.  It is scheduled after LambdaD.
+	TrafficDropDecoy
+
+	numTrafficKinds
+)
+
+// TrafficScheduler decides when the session worker sends each kind of
+// traffic.  It is only called from the session worker.
+type TrafficScheduler interface {
+	// SetDocument updates the rates with those of a new PKI document.
+	SetDocument(doc *pki.Document)
+
+	// Next returns how long to wait before sending traffic of the given
+	// kind again.
+	Next(kind TrafficKind) time.Duration
+}
+
+// trafficRates returns the rate, in messages per millisecond, and the
+// maximum delay, in milliseconds, of the traffic kind.
+func trafficRates(doc *pki.Document, kind TrafficKind) (float64, uint64) {
+	switch kind {
+	case TrafficSend:
+		return doc.LambdaP, doc.LambdaPMaxDelay
+	case TrafficLoopDecoy:
+		return doc.LambdaL, doc.LambdaLMaxDelay
+	default:
+		return doc.LambdaD, doc.LambdaDMaxDelay
+	}
+}
+
+// PoissonScheduler sends each kind of traffic after exponentially
+// distributed delays, as mandated by the Loopix design.
+type PoissonScheduler struct {
+	doc *pki.Document
+	rng *rand.Rand
+}
+
+// NewPoissonScheduler returns a new PoissonScheduler sampling the delays
+// with rng.
+func NewPoissonScheduler(rng *rand.Rand) *PoissonScheduler {
+	return &PoissonScheduler{
+		rng: rng,
+	}
+}
+
+// SetDocument implements TrafficScheduler.
+func (p *PoissonScheduler) SetDocument(doc *pki.Document) {
+	p.doc = doc
+}
+
+// Next implements TrafficScheduler.
+func (p *PoissonScheduler) Next(kind TrafficKind) time.Duration {
+	lambda, maxDelay := trafficRates(p.doc, kind)
+	msec := uint64(cRand.Exp(p.rng, lambda))
+	if msec > maxDelay {
+		msec = maxDelay
+	}
+	return time.Duration(msec) * time.Millisecond
+}
+
+// ConstantScheduler sends each kind of traffic at a constant interval,
+// the mean delay of the Poisson process of the PKI document.  It has the
+// same average bandwidth as the PoissonScheduler but its timing does not
+// blend in with Poisson distributed traffic.
+type ConstantScheduler struct {
+	doc *pki.Document
+}
+
+// NewConstantScheduler returns a new ConstantScheduler.
+func NewConstantScheduler() *ConstantScheduler {
+	return new(ConstantScheduler)
+}
+
+// SetDocument implements TrafficScheduler.
+func (c *ConstantScheduler) SetDocument(doc *pki.Document) {
+	c.doc = doc
+}
+
+// Next implements TrafficScheduler.
+func (c *ConstantScheduler) Next(kind TrafficKind) time.Duration {
+	lambda, maxDelay := trafficRates(c.doc, kind)
+	msec := float64(maxDelay)
+	if lambda > 0 && 1/lambda < msec {
+		msec = 1 / lambda
+	}
+	return time.Duration(msec * float64(time.Millisecond))
+}
+
+// BurstScheduler sends traffic following the Poisson process of the PKI
+// document during bursts, and nothing while idle in between, so that the
+// radio of battery or bandwidth constrained hosts can sleep.  Bursts are
+// aligned to the wall clock so that every kind of traffic shares them.
+type BurstScheduler struct {
+	poisson *PoissonScheduler
+	clock   clock.Clock
+	burst   time.Duration
+	idle    time.Duration
+}
+
+// NewBurstScheduler returns a new BurstScheduler sending during bursts of
+// the given duration separated by idle periods, sampling the delays with
+// rng.
+func NewBurstScheduler(clk clock.Clock, rng *rand.Rand, burst, idle time.Duration) (*BurstScheduler, error) {
+	if burst <= 0 || idle < 0 {
+		return nil, errors.New("invalid burst scheduler durations")
+	}
+	return &BurstScheduler{
+		poisson: NewPoissonScheduler(rng),
+		clock:   clk,
+		burst:   burst,
+		idle:    idle,
+	}, nil
+}
+
+// SetDocument implements TrafficScheduler.
+func (b *BurstScheduler) SetDocument(doc *pki.Document) {
+	b.poisson.SetDocument(doc)
+}
+
+// Next implements TrafficScheduler.
+func (b *BurstScheduler) Next(kind TrafficKind) time.Duration {
+	return b.postpone(b.clock.Now(), b.poisson.Next(kind))
+}
+
+// postpone delays the send due after delay from now into the next burst if
+// it falls in an idle period.
+func (b *BurstScheduler) postpone(now time.Time, delay time.Duration) time.Duration {
+	period := b.burst + b.idle
+	offset := time.Duration(now.Add(delay).UnixNano() % int64(period))
+	if offset < b.burst {
+		return delay
+	}
+	return delay + period - offset
+}
+
+// newTrafficScheduler returns the traffic scheduler selected in the
+// configuration.
+func newTrafficScheduler(cfg *config.Config, clk clock.Clock, rng *rand.Rand) (TrafficScheduler, error) {
+	if cfg.Traffic == nil {
+		return NewPoissonScheduler(rng), nil
+	}
+	switch cfg.Traffic.Scheduler {
+	case "", config.TrafficPoisson:
+		return NewPoissonScheduler(rng), nil
+	case config.TrafficConstant:
+		return NewConstantScheduler(), nil
+	case config.TrafficBurst:
+		return NewBurstScheduler(
+			clk,
+			rng,
+			time.Duration(cfg.Traffic.BurstDuration)*time.Second,
+			time.Duration(cfg.Traffic.IdleDuration)*time.Second,
+		)
+	default:
+		return nil, errors.New("invalid traffic scheduler")
+	}
+}
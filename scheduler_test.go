@@ -0,0 +1,106 @@
+package client
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	"github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTrafficDocument() *pki.Document {
+	return &pki.Document{
+		LambdaP:         0.01,
+		LambdaPMaxDelay: 1000,
+		LambdaL:         0.0005,
+		LambdaLMaxDelay: 1000,
+		LambdaD:         0.002,
+		LambdaDMaxDelay: 1000,
+	}
+}
+
+func TestPoissonScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	p := NewPoissonScheduler(rand.New(rand.NewSource(1)))
+	p.SetDocument(newTestTrafficDocument())
+	var total time.Duration
+	for i := 0; i < 1000; i++ {
+		d := p.Next(TrafficSend)
+		assert.True(d >= 0 && d <= time.Second)
+		total += d
+	}
+	// the mean delay is 1/LambdaP
+	assert.InDelta(float64(100*time.Millisecond), float64(total/1000), float64(10*time.Millisecond))
+
+	// the schedule is reproducible
+	a := NewPoissonScheduler(rand.New(rand.NewSource(42)))
+	b := NewPoissonScheduler(rand.New(rand.NewSource(42)))
+	a.SetDocument(newTestTrafficDocument())
+	b.SetDocument(newTestTrafficDocument())
+	for i := 0; i < 10; i++ {
+		assert.Equal(a.Next(TrafficLoopDecoy), b.Next(TrafficLoopDecoy))
+	}
+}
+
+func TestConstantScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewConstantScheduler()
+	c.SetDocument(newTestTrafficDocument())
+	assert.Equal(100*time.Millisecond, c.Next(TrafficSend))
+	assert.Equal(500*time.Millisecond, c.Next(TrafficDropDecoy))
+	// the mean delay is bounded by the maximum delay
+	assert.Equal(time.Second, c.Next(TrafficLoopDecoy))
+}
+
+func TestBurstScheduler(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	// bursts start every 5 minutes since the Unix epoch
+	start := time.Unix(0, 0).Add(1000 * 5 * time.Minute)
+	clk := clock.NewFake(start)
+	rng := rand.New(rand.NewSource(1))
+
+	_, err := NewBurstScheduler(clk, rng, 0, time.Minute)
+	assert.Error(err)
+	b, err := NewBurstScheduler(clk, rng, time.Minute, 4*time.Minute)
+	require.NoError(err)
+
+	assert.Equal(time.Second, b.postpone(start, time.Second))
+	assert.Equal(time.Second, b.postpone(start.Add(58*time.Second), time.Second))
+	assert.Equal(4*time.Minute+time.Second, b.postpone(start.Add(59*time.Second), time.Second))
+	assert.Equal(3*time.Minute, b.postpone(start.Add(2*time.Minute), 0))
+
+	// every send falls within a burst
+	b.SetDocument(newTestTrafficDocument())
+	for i := 0; i < 100; i++ {
+		clk.Advance(b.Next(TrafficSend))
+		offset := clk.Now().Sub(start) % (5 * time.Minute)
+		assert.True(offset < time.Minute)
+	}
+}
+
+func TestNewTrafficScheduler(t *testing.T) {
+	assert := assert.New(t)
+
+	rng := rand.New(rand.NewSource(1))
+	cfg := new(config.Config)
+	scheduler, err := newTrafficScheduler(cfg, clock.Real, rng)
+	assert.NoError(err)
+	assert.IsType(&PoissonScheduler{}, scheduler)
+
+	cfg.Traffic = &config.Traffic{Scheduler: config.TrafficBurst, BurstDuration: 1, IdleDuration: 2}
+	scheduler, err = newTrafficScheduler(cfg, clock.Real, rng)
+	assert.NoError(err)
+	assert.IsType(&BurstScheduler{}, scheduler)
+
+	cfg.Traffic.Scheduler = "bogus"
+	_, err = newTrafficScheduler(cfg, clock.Real, rng)
+	assert.Error(err)
+}
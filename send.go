@@ -17,6 +17,7 @@
 package client
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -33,29 +34,107 @@ import (
 var ErrReplyTimeout = errors.New("failure waiting for reply, timeout reached")
 var ErrMessageNotSent = errors.New("failure sending message")
 
+// ErrMessageAlreadySent is the error issued when cancelling a message which
+// already left the egress queue.
+var ErrMessageAlreadySent = errors.New("message was already sent")
+
 func (s *Session) sendNext() {
+	// The message peeked at must be the one popped.
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
 	msg, err := s.egressQueue.Peek()
 	if err != nil {
-		s.fatalErrCh <- errors.New("impossible failure to Peek from queue")
+		s.fatal(errors.New("impossible failure to Peek from queue"))
 		return
 	}
 	if msg == nil {
-		s.fatalErrCh <- errors.New("impossible failure, got nil message from queue")
+		s.fatal(errors.New("impossible failure, got nil message from queue"))
 		return
 	}
 	m := msg.(*Message)
-	s.doSend(m)
+	if m.IsBlocking && !s.hasSentWaiter(m) {
+		// The caller is no longer waiting for this message.
+		s.log.Debugf("Dropping blocking message %x, caller gave up", *m.ID)
+		s.statuses.setState(m.ID, MessageCancelled, nil)
+	} else {
+		s.doSend(m)
+	}
 	_, err = s.egressQueue.Pop()
 	if err != nil {
-		s.fatalErrCh <- errors.New("impossible failure to Pop from queue")
+		s.fatal(errors.New("impossible failure to Pop from queue"))
+	}
+}
+
+// enqueue pushes msg onto the egress queue and records it as queued.
+func (s *Session) enqueue(msg *Message) error {
+	s.statuses.queued(msg.ID)
+	if err := s.egressQueue.Push(msg); err != nil {
+		s.statuses.remove(msg.ID)
+		return err
+	}
+	return nil
+}
+
+// CancelMessage removes a message from the egress queue before it is sent.
+// ErrMessageAlreadySent is returned if the message already left the queue,
+// in which case a reliable message is no longer retransmitted.
+// ErrQueueNotRemovable is returned if the egress queue is not a
+// RemovableQueue.
+func (s *Session) CancelMessage(id *[cConstants.MessageIDLength]byte) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	queue, ok := s.egressQueue.(RemovableQueue)
+	if !ok {
+		return ErrQueueNotRemovable
+	}
+	_, err := queue.Remove(func(item Item) bool {
+		msg, ok := item.(*Message)
+		return ok && msg.ID != nil && *msg.ID == *id
+	})
+	s.arqMap.Delete(*id)
+	switch err {
+	case nil:
+	case ErrQueueItemNotFound:
+		if _, ok := s.statuses.get(id); ok {
+			return ErrMessageAlreadySent
+		}
+		return ErrMessageStatusNotFound
+	default:
+		return err
+	}
+
+	s.statuses.setState(id, MessageCancelled, nil)
+	s.completeBatchMessage(id, MessageCancelled, nil, nil)
+	if sentWaitChanRaw, ok := s.sentWaitChanMap.Load(*id); ok {
+		// Unblock the caller waiting for the message to be sent.
+		close(sentWaitChanRaw.(chan *Message))
 	}
+	return nil
+}
+
+// cancelUnsent cancels a blocking message whose caller gave up before it
+// was sent.  If the egress queue cannot remove it, the message is dropped
+// once it reaches the head of the queue, as its sentWaitChan is gone.
+func (s *Session) cancelUnsent(msg *Message) {
+	switch s.CancelMessage(msg.ID) {
+	case nil, ErrMessageAlreadySent:
+	default:
+		s.statuses.setState(msg.ID, MessageCancelled, nil)
+	}
+}
+
+func (s *Session) hasSentWaiter(msg *Message) bool {
+	_, ok := s.sentWaitChanMap.Load(*msg.ID)
+	return ok
 }
 
 func (s *Session) doSend(msg *Message) {
 	surbID := [sConstants.SURBIDLength]byte{}
 	_, err := io.ReadFull(rand.Reader, surbID[:])
 	if err != nil {
-		s.fatalErrCh <- fmt.Errorf("impossible failure, failed to generate SURB ID for message ID %x", *msg.ID)
+		s.fatal(fmt.Errorf("impossible failure, failed to generate SURB ID for message ID %x", *msg.ID))
 		return
 	}
 	key := []byte{}
@@ -63,29 +142,49 @@ func (s *Session) doSend(msg *Message) {
 	if msg.WithSURB {
 		idStr := fmt.Sprintf("[%v]", hex.EncodeToString(surbID[:]))
 		s.log.Debugf("doSend with SURB ID %x", idStr)
-		key, eta, err = s.minclient.SendCiphertext(msg.Recipient, msg.Provider, &surbID, msg.Payload)
+		key, eta, err = s.currentMinclient().SendCiphertext(msg.Recipient, msg.Provider, &surbID, msg.Payload)
 	} else {
 		s.log.Debugf("doSend without SURB")
-		err = s.minclient.SendUnreliableCiphertext(msg.Recipient, msg.Provider, msg.Payload)
+		err = s.currentMinclient().SendUnreliableCiphertext(msg.Recipient, msg.Provider, msg.Payload)
 	}
 
 	// message was sent
 	if err == nil {
-		msg.SentAt = time.Now()
+		msg.SentAt = s.clock.Now()
+	}
+	if !msg.IsDecoy {
+		s.statuses.sent(msg, eta, err)
+		if err != nil {
+			s.completeBatchMessage(msg.ID, MessageFailed, nil, err)
+		}
 	}
+
 	// expect a reply
 	if msg.WithSURB {
 		if err == nil {
 			s.log.Debugf("doSend setting ReplyETA to %v", eta)
 			msg.ReplyETA = eta
 			msg.Key = key
-			s.surbIDMap.Store(surbID, msg)
+			msg.SURBID = &surbID
+			if msg.Reliable {
+				// Each retransmission uses a fresh SURB, keep the
+				// keys of this one around for late replies.
+				sent := *msg
+				s.surbIDMap.Store(surbID, &sent)
+			} else {
+				s.surbIDMap.Store(surbID, msg)
+			}
+		}
+		if msg.Reliable {
+			s.onARQSent(msg, err)
 		}
 		// write to waiting channel or close channel if message failed to send
 		if msg.IsBlocking {
 			sentWaitChanRaw, ok := s.sentWaitChanMap.Load(*msg.ID)
 			if !ok {
-				s.fatalErrCh <- fmt.Errorf("impossible failure, sentWaitChan not found for message ID %x", *msg.ID)
+				// The caller gave up while the message was being sent.
+				s.log.Debugf("Discarding blocking message %x, caller gave up", *msg.ID)
+				s.surbIDMap.Delete(surbID)
 				return
 			}
 			sentWaitChan := sentWaitChanRaw.(chan *Message)
@@ -109,14 +208,14 @@ func (s *Session) sendDropDecoy() {
 	s.log.Info("sending drop decoy")
 	serviceDesc, err := s.GetService(cConstants.LoopService)
 	if err != nil {
-		s.fatalErrCh <- errors.New("failure to get loop service")
+		s.fatal(errors.New("failure to get loop service"))
 		return
 	}
 	payload := [constants.UserForwardPayloadLength]byte{}
 	id := [cConstants.MessageIDLength]byte{}
 	_, err = io.ReadFull(rand.Reader, id[:])
 	if err != nil {
-		s.fatalErrCh <- errors.New("failure to generate message ID for drop decoy")
+		s.fatal(errors.New("failure to generate message ID for drop decoy"))
 		return
 	}
 	msg := &Message{
@@ -132,16 +231,21 @@ func (s *Session) sendDropDecoy() {
 
 func (s *Session) sendLoopDecoy() {
 	s.log.Info("sending loop decoy")
+	doc := s.CurrentDocument()
+	if doc == nil {
+		s.log.Debug("Not sending loop decoy, PKI doc is nil")
+		return
+	}
 	serviceDesc, err := s.GetService(cConstants.LoopService)
 	if err != nil {
-		s.fatalErrCh <- errors.New("failure to get loop service")
+		s.fatal(errors.New("failure to get loop service"))
 		return
 	}
 	payload := [constants.UserForwardPayloadLength]byte{}
 	id := [cConstants.MessageIDLength]byte{}
 	_, err = io.ReadFull(rand.Reader, id[:])
 	if err != nil {
-		s.fatalErrCh <- errors.New("failure to generate message ID for loop decoy")
+		s.fatal(errors.New("failure to generate message ID for loop decoy"))
 		return
 	}
 	msg := &Message{
@@ -152,8 +256,10 @@ func (s *Session) sendLoopDecoy() {
 		WithSURB:  true,
 		IsDecoy:   true,
 	}
-	defer s.incrementDecoyLoopTally()
 	s.doSend(msg)
+	if msg.SURBID != nil {
+		s.decoyStats.sent(msg.ID, doc.Epoch)
+	}
 }
 
 func (s *Session) composeMessage(recipient, provider string, message []byte, isBlocking bool) (*Message, error) {
@@ -182,37 +288,106 @@ func (s *Session) composeMessage(recipient, provider string, message []byte, isB
 
 // SendUnreliableMessage asynchronously sends message without any automatic retransmissions.
 func (s *Session) SendUnreliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	return s.SendUnreliableMessageWithPriority(recipient, provider, message, 0)
+}
+
+// SendUnreliableMessageWithPriority is like SendUnreliableMessage but sets
+// the queue priority of the message, higher priority messages are sent
+// first when the priority egress queue is in use.
+func (s *Session) SendUnreliableMessageWithPriority(recipient, provider string, message []byte, priority uint64) (*[cConstants.MessageIDLength]byte, error) {
 	msg, err := s.composeMessage(recipient, provider, message, false)
 	if err != nil {
 		return nil, err
 	}
-	err = s.egressQueue.Push(msg)
+	msg.QueuePriority = priority
+	err = s.enqueue(msg)
 	if err != nil {
 		return nil, err
 	}
 	return msg.ID, nil
 }
 
+// BlockingSendUnreliableMessage sends message without any automatic
+// retransmissions and blocks until the reply is received or the round trip
+// timeout is reached.
 func (s *Session) BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error) {
+	return s.SendAndWait(context.Background(), recipient, provider, message)
+}
+
+// SendUnreliableMessageWithReplyCheck is like SendUnreliableMessage but the
+// reply is validated by check, whose error is set as the Err of the
+// MessageReplyEvent.
+func (s *Session) SendUnreliableMessageWithReplyCheck(recipient, provider string, message []byte, check func(reply []byte) error) (*[cConstants.MessageIDLength]byte, error) {
+	msg, err := s.composeMessage(recipient, provider, message, false)
+	if err != nil {
+		return nil, err
+	}
+	msg.ReplyCheck = check
+	err = s.enqueue(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg.ID, nil
+}
+
+// SendAndWait sends message without any automatic retransmissions and
+// blocks until the reply is received, the context is done or the round
+// trip timeout is reached.  The round trip timeout is the ReplyETA of the
+// message plus the slop estimated from the previous replies of the same
+// service, see RTTEstimate.
+func (s *Session) SendAndWait(ctx context.Context, recipient, provider string, message []byte) ([]byte, error) {
+	return s.sendAndWait(ctx, recipient, provider, message, adaptiveGrace, 0)
+}
+
+// SendAndWaitWithGrace is like SendAndWait but waits for the reply until
+// the ReplyETA of the message plus the supplied grace period.
+func (s *Session) SendAndWaitWithGrace(ctx context.Context, recipient, provider string, message []byte, grace time.Duration) ([]byte, error) {
+	return s.sendAndWait(ctx, recipient, provider, message, grace, 0)
+}
+
+// SendAndWaitWithPriority is like SendAndWait but sets the queue priority
+// of the message.
+func (s *Session) SendAndWaitWithPriority(ctx context.Context, recipient, provider string, message []byte, priority uint64) ([]byte, error) {
+	return s.sendAndWait(ctx, recipient, provider, message, adaptiveGrace, priority)
+}
+
+// adaptiveGrace makes sendAndWait use the estimated round trip timeout.
+const adaptiveGrace = time.Duration(-1)
+
+func (s *Session) sendAndWait(ctx context.Context, recipient, provider string, message []byte, grace time.Duration, priority uint64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	msg, err := s.composeMessage(recipient, provider, message, true)
 	if err != nil {
 		return nil, err
 	}
-	sentWaitChan := make(chan *Message)
+	msg.QueuePriority = priority
+	// The channels are buffered so that the session never blocks on a
+	// caller which gave up.
+	sentWaitChan := make(chan *Message, 1)
 	s.sentWaitChanMap.Store(*msg.ID, sentWaitChan)
 	defer s.sentWaitChanMap.Delete(*msg.ID)
 
-	replyWaitChan := make(chan []byte)
+	replyWaitChan := make(chan []byte, 1)
 	s.replyWaitChanMap.Store(*msg.ID, replyWaitChan)
 	defer s.replyWaitChanMap.Delete(*msg.ID)
 
-	err = s.egressQueue.Push(msg)
+	err = s.enqueue(msg)
 	if err != nil {
 		return nil, err
 	}
 
 	// wait until sent so that we know the ReplyETA for the waiting below
-	sentMessage := <-sentWaitChan
+	var sentMessage *Message
+	select {
+	case sentMessage = <-sentWaitChan:
+	case <-ctx.Done():
+		s.cancelUnsent(msg)
+		return nil, ctx.Err()
+	case <-s.HaltCh():
+		return nil, ErrMessageNotSent
+	}
 
 	// if the message failed to send we will receive a nil message
 	if sentMessage == nil {
@@ -220,11 +395,24 @@ func (s *Session) BlockingSendUnreliableMessage(recipient, provider string, mess
 	}
 
 	// wait for reply or round trip timeout
+	timeout := sentMessage.ReplyETA + grace
+	if grace == adaptiveGrace {
+		timeout = s.replyTimeout(sentMessage)
+	}
+	timer := s.clock.NewTimer(timeout)
+	defer timer.Stop()
 	select {
 	case reply := <-replyWaitChan:
 		return reply, nil
-	// these timeouts are often far too aggressive
-	case <-time.After(sentMessage.ReplyETA + cConstants.RoundTripTimeSlop):
+	case <-timer.C():
+		// The SURB is left to the garbage collection so that a late
+		// reply still updates the round trip time estimate.
+		s.statuses.setState(msg.ID, MessageTimedOut, ErrReplyTimeout)
+		return nil, ErrReplyTimeout
+	case <-ctx.Done():
+		s.surbIDMap.Delete(*sentMessage.SURBID)
+		return nil, ctx.Err()
+	case <-s.HaltCh():
 		return nil, ErrReplyTimeout
 	}
 	// unreachable
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// cancelBeforeSend calls sendAndWait on s and cancels it once the message is
+// queued, returning the cancelled message.
+func cancelBeforeSend(t *testing.T, s *Session, q *Queue) *Message {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := s.sendAndWait(ctx, "recipient", "provider", []byte("hello"), adaptiveGrace, 0)
+		errCh <- err
+	}()
+	var msg *Message
+	for msg == nil {
+		if item, err := q.Peek(); err == nil {
+			msg = item.(*Message)
+		}
+	}
+	cancel()
+	require.Equal(t, context.Canceled, <-errCh)
+	return msg
+}
+
+func TestSendAndWaitCancelBeforeSend(t *testing.T) {
+	assert := assert.New(t)
+
+	q := new(Queue)
+	s := &Session{
+		log:         logging.MustGetLogger("test"),
+		egressQueue: q,
+		statuses:    newStatusHistory(clock.Real),
+	}
+	msg := cancelBeforeSend(t, s, q)
+	_, err := q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+	status, err := s.MessageStatus(msg.ID)
+	require.NoError(t, err)
+	assert.Equal(MessageCancelled, status.State)
+
+	// a queue which cannot remove the message drops it at the head
+	s.egressQueue = struct{ EgressQueue }{q}
+	msg = cancelBeforeSend(t, s, q)
+	status, err = s.MessageStatus(msg.ID)
+	require.NoError(t, err)
+	assert.Equal(MessageCancelled, status.State)
+	s.sendNext()
+	_, err = q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+	status, _ = s.MessageStatus(msg.ID)
+	assert.Equal(MessageCancelled, status.State)
+}
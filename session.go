@@ -21,11 +21,13 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	mrand "math/rand"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/hashcloak/Meson-client/clock"
 	"github.com/hashcloak/Meson-client/config"
 	"github.com/hashcloak/Meson-client/minclient"
 	kpki "github.com/hashcloak/Meson-client/pkiclient"
@@ -33,6 +35,7 @@ import (
 	"github.com/katzenpost/client/utils"
 	coreConstants "github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
 	cpki "github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx"
@@ -46,28 +49,129 @@ import (
 type Session struct {
 	worker.Worker
 
-	cfg       *config.Config
-	pkiClient kpki.Client
-	minclient *minclient.Client
-	log       *logging.Logger
+	cfg        *config.Config
+	pkiClient  kpki.Client
+	log        *logging.Logger
+	logBackend *log.Backend
+
+	// minclientLock guards minclient and account, which are replaced
+	// when failing over to another Provider or resuming, and the pause
+	// state.
+	minclientLock sync.RWMutex
+	minclient     providerClient
+	account       *config.Account
+
+	// newMinclient brings up the minclient instances.
+	newMinclient func(cfg *minclient.ClientConfig) (providerClient, error)
+
+	// paused is set while the session is paused and minclient is shut
+	// down, lastDocument is then the last PKI document it had.
+	paused       bool
+	pausedAt     time.Time
+	lastDocument *cpki.Document
+
+	// pauseLock serializes pausing, resuming and failing over.
+	pauseLock sync.Mutex
+
+	// clientGeneration is incremented each time minclient is replaced,
+	// callbacks from previous instances are ignored.
+	clientGeneration uint64
+	failingOver      uint32
+
+	// ownedPKIClient is the PKI client created by NewSession, if any,
+	// which is shut down along with the session.
+	ownedPKIClient kpki.Client
 
 	fatalErrCh chan error
 	opCh       chan workerOp
 
-	eventCh   channels.Channel
+	// clock and newRand are the sources of time and of non-cryptographic
+	// randomness, which tests replace to be deterministic, see WithClock
+	// and WithRand.  rng is the source of the service selection.
+	clock   clock.Clock
+	newRand func() *mrand.Rand
+	rngLock sync.Mutex
+	rng     *mrand.Rand
+
+	eventCh channels.Channel
+
+	// EventSink receives every event.  None is dropped: the events are
+	// buffered in memory until read, without delaying the other
+	// subscriptions, so it must be read.  Use Subscribe for filtered
+	// or bounded delivery.
 	EventSink chan Event
 
+	subscriptionsLock sync.RWMutex
+	subscriptions     []*Subscription
+
 	linkKey   *ecdh.PrivateKey
 	onlineAt  time.Time
 	hasPKIDoc bool
 
 	egressQueue EgressQueue
+	scheduler   TrafficScheduler
+	budget      *bandwidthBudget
+
+	docPolicyLock sync.RWMutex
+	docPolicy     DocumentPolicy
+
+	// sendLock serializes sending from and removing from the egress queue.
+	sendLock sync.Mutex
 
 	surbIDMap        sync.Map // [sConstants.SURBIDLength]byte -> *Message
 	sentWaitChanMap  sync.Map // MessageID -> chan *Message
 	replyWaitChanMap sync.Map // MessageID -> chan []byte
 
-	decoyLoopTally uint64
+	batches sync.Map // MessageID -> *Batch
+
+	arqMap        sync.Map // MessageID -> *arqMessage
+	arqTimerQueue *TimerQueue
+
+	inboundCh     chan []byte
+	inboundReplay *replayCache
+
+	replyReassembler *Reassembler
+
+	statuses *statusHistory
+	rtts     *rttTable
+
+	decoyStats *loopDecoyStats
+}
+
+// providerClient is the connection to the Provider, a *minclient.Client
+// unless replaced by tests.
+type providerClient interface {
+	CurrentDocument() *cpki.Document
+	ClockSkew() time.Duration
+	SendCiphertext(recipient, provider string, surbID *[sConstants.SURBIDLength]byte, b []byte) ([]byte, time.Duration, error)
+	SendUnreliableCiphertext(recipient, provider string, b []byte) error
+	Shutdown()
+	Wait()
+}
+
+func newMinclient(cfg *minclient.ClientConfig) (providerClient, error) {
+	return minclient.New(cfg)
+}
+
+// SessionOption is an optional setting of a Session.
+type SessionOption func(*Session)
+
+// WithClock sets the source of time of the session, and of its minclient
+// instances, which is the system clock by default.
+func WithClock(clk clock.Clock) SessionOption {
+	return func(s *Session) {
+		s.clock = clk
+	}
+}
+
+// WithRand sets the function returning the sources of non-cryptographic
+// randomness of the session, used for the traffic schedule, the path
+// selection and hop delays, and the service selection.  It is
+// rand.NewMath by default.
+func WithRand(newRand func() *mrand.Rand) SessionOption {
+	return func(s *Session) {
+		s.newRand = newRand
+	}
 }
 
 // New establishes a session with provider using key.
@@ -77,58 +181,100 @@ func NewSession(
 	fatalErrCh chan error,
 	logBackend *log.Backend,
 	cfg *config.Config,
-	linkKey *ecdh.PrivateKey) (*Session, error) {
-	var err error
-
+	linkKey *ecdh.PrivateKey,
+	opts ...SessionOption) (*Session, error) {
 	// create a pkiclient for our own client lookups
 	// AND create a pkiclient for minclient's use
 	proxyCfg := cfg.UpstreamProxyConfig()
 	pkiClient, err := cfg.NewPKIClient(logBackend, proxyCfg)
 	if err != nil {
-		fmt.Println("GG1")
 		return nil, err
 	}
 
-	// TODO: create a pkiclient for minclient's use
-	// can only open database once
+	// can only open database once, so the cache client is
+	// shared by our own lookups and minclient
 	pkiCacheClient := kpki.NewCacheClient(pkiClient)
 
+	s, err := newSession(ctx, fatalErrCh, logBackend, cfg, linkKey, pkiCacheClient, opts...)
+	if err != nil {
+		pkiCacheClient.Shutdown()
+		pkiClient.Shutdown()
+		return nil, err
+	}
+	s.ownedPKIClient = pkiClient
+	return s, nil
+}
+
+// newSession establishes a session using a PKI client which may be shared
+// with other sessions.
+func newSession(
+	ctx context.Context,
+	fatalErrCh chan error,
+	logBackend *log.Backend,
+	cfg *config.Config,
+	linkKey *ecdh.PrivateKey,
+	pkiCacheClient kpki.Client,
+	opts ...SessionOption) (*Session, error) {
+	var err error
+
+	if !cfg.Registration.PermitsProvider(cfg.Account.Provider) {
+		return nil, fmt.Errorf("provider %v is not permitted by the provider selection policy", cfg.Account.Provider)
+	}
+
 	clientLog := logBackend.GetLogger(fmt.Sprintf("%s@%s_client", cfg.Account.User, cfg.Account.Provider))
 	s := &Session{
-		cfg:         cfg,
-		linkKey:     linkKey,
-		pkiClient:   pkiCacheClient,
-		log:         clientLog,
-		fatalErrCh:  fatalErrCh,
-		eventCh:     channels.NewInfiniteChannel(),
-		EventSink:   make(chan Event),
-		opCh:        make(chan workerOp, 8),
-		egressQueue: new(Queue),
+		cfg:          cfg,
+		linkKey:      linkKey,
+		pkiClient:    pkiCacheClient,
+		log:          clientLog,
+		logBackend:   logBackend,
+		fatalErrCh:   fatalErrCh,
+		eventCh:      channels.NewInfiniteChannel(),
+		opCh:         make(chan workerOp, 8),
+		clock:        clock.Real,
+		newRand:      rand.NewMath,
+		newMinclient: newMinclient,
+		docPolicy:    NewConfigDocumentPolicy(cfg.DocumentPolicy),
+
+		inboundCh:     make(chan []byte, inboundQueueSize),
+		inboundReplay: newReplayCache(),
+
+		rtts:       newRTTTable(),
+		decoyStats: newLoopDecoyStats(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
-	// Configure and bring up the minclient instance.
-	clientCfg := &minclient.ClientConfig{
-		User:                cfg.Account.User,
-		Provider:            cfg.Account.Provider,
-		ProviderKeyPin:      cfg.Account.ProviderKeyPin,
-		LinkKey:             s.linkKey,
-		LogBackend:          logBackend,
-		PKIClient:           pkiCacheClient,
-		OnConnFn:            s.onConnection,
-		OnMessageFn:         s.onMessage,
-		OnACKFn:             s.onACK,
-		OnDocumentFn:        s.onDocument,
-		DialContextFn:       proxyCfg.ToDialContext("authority"),
-		PreferedTransports:  cfg.Debug.PreferedTransports,
-		MessagePollInterval: time.Duration(cfg.Debug.PollingInterval) * time.Millisecond,
-		EnableTimeSync:      false, // Be explicit about it.
+	scheduler, err := newTrafficScheduler(cfg, s.clock, s.newRand())
+	if err != nil {
+		return nil, err
+	}
+	s.scheduler = scheduler
+	s.egressQueue, err = newEgressQueue(cfg, linkKey, s.clock)
+	if err != nil {
+		return nil, err
+	}
+	s.rng = s.newRand()
+	s.statuses = newStatusHistory(s.clock)
+	s.replyReassembler = NewReassemblerWithClock(DefaultReassemblyTimeout, s.clock)
+	if cfg.Bandwidth != nil {
+		s.budget = newBandwidthBudget(cfg.Bandwidth, s.clock.Now())
+		s.scheduler = &budgetScheduler{
+			TrafficScheduler: scheduler,
+			budget:           s.budget,
+			notify:           s.emitBandwidthBudget,
+		}
 	}
 
+	s.EventSink = s.Subscribe(nil, 0, Unbounded).ch
 	s.Go(s.eventSinkWorker)
 	s.Go(s.garbageCollectionWorker)
 
-	s.minclient, err = minclient.New(clientCfg)
-	if err != nil {
+	// Configure and bring up the minclient instance.
+	if _, err = s.replaceMinclient(cfg.Account); err != nil {
+		s.Halt()
+		s.closeEgressQueue()
 		return nil, err
 	}
 
@@ -136,12 +282,117 @@ func NewSession(
 	// and then set our timers accordingly
 	err = s.awaitFirstPKIDoc(ctx)
 	if err != nil {
+		s.Halt()
+		s.currentMinclient().Shutdown()
+		s.closeEgressQueue()
 		return nil, err
 	}
+	s.arqTimerQueue = NewTimerQueueWithClock(&arqRetransmitter{s: s}, s.clock)
+	s.replayEgressQueue()
 	s.Go(s.worker)
 	return s, nil
 }
 
+// replayEgressQueue restores the state of the messages queued before a
+// restart so that they are sent as if they were just queued.
+func (s *Session) replayEgressQueue() {
+	q, ok := s.egressQueue.(*PersistentQueue)
+	if !ok {
+		return
+	}
+	messages := q.Messages()
+	if len(messages) == 0 {
+		return
+	}
+	s.log.Noticef("Replaying %d queued messages", len(messages))
+	for _, msg := range messages {
+		s.statuses.queued(msg.ID)
+		if msg.Reliable {
+			s.arqMap.Store(*msg.ID, &arqMessage{msg: msg})
+		}
+	}
+}
+
+// fatal reports an unrecoverable error, upon which the session is shut down.
+func (s *Session) fatal(err error) {
+	select {
+	case s.fatalErrCh <- err:
+	case <-s.HaltCh():
+	}
+}
+
+func (s *Session) closeEgressQueue() {
+	if c, ok := s.egressQueue.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			s.log.Errorf("Failed to close the egress queue: %v", err)
+		}
+	}
+}
+
+// replaceMinclient brings up a minclient instance for the account and
+// makes it the current one, returning the instance it replaced if any.
+func (s *Session) replaceMinclient(account *config.Account) (providerClient, error) {
+	s.minclientLock.Lock()
+	defer s.minclientLock.Unlock()
+
+	generation := atomic.AddUint64(&s.clientGeneration, 1)
+	isCurrent := func() bool {
+		return atomic.LoadUint64(&s.clientGeneration) == generation
+	}
+	proxyCfg := s.cfg.UpstreamProxyConfig()
+	clientCfg := &minclient.ClientConfig{
+		User:           account.User,
+		Provider:       account.Provider,
+		ProviderKeyPin: account.ProviderKeyPin,
+		LinkKey:        s.linkKey,
+		LogBackend:     s.logBackend,
+		PKIClient:      s.pkiClient,
+		OnConnFn: func(err error) {
+			if isCurrent() {
+				s.onConnection(generation, err)
+			}
+		},
+		OnMessageFn: s.onMessage,
+		OnACKFn:     s.onACK,
+		OnDocumentFn: func(doc *cpki.Document) {
+			if isCurrent() {
+				s.onDocument(generation, doc)
+			}
+		},
+		DialContextFn:       proxyCfg.ToDialContext("authority"),
+		PreferedTransports:  s.cfg.Debug.PreferedTransports,
+		MessagePollInterval: time.Duration(s.cfg.Debug.PollingInterval) * time.Millisecond,
+		EnableTimeSync:      s.cfg.TimeSync != nil && s.cfg.TimeSync.Enable,
+		Clock:               s.clock,
+		Rand:                s.newRand(),
+	}
+	client, err := s.newMinclient(clientCfg)
+	if err != nil {
+		// Keep using the previous instance.
+		atomic.StoreUint64(&s.clientGeneration, generation-1)
+		return nil, err
+	}
+	old := s.minclient
+	s.minclient = client
+	s.account = account
+	return old, nil
+}
+
+// currentMinclient returns the minclient instance currently in use.
+func (s *Session) currentMinclient() providerClient {
+	s.minclientLock.RLock()
+	defer s.minclientLock.RUnlock()
+	return s.minclient
+}
+
+// Account returns the Provider account the session currently uses,
+// which changes when failing over to another Provider.
+func (s *Session) Account() *config.Account {
+	s.minclientLock.RLock()
+	defer s.minclientLock.RUnlock()
+	return s.account
+}
+
 func (s *Session) eventSinkWorker() {
 	for {
 		select {
@@ -149,25 +400,20 @@ func (s *Session) eventSinkWorker() {
 			s.log.Debugf("Event sink worker terminating gracefully.")
 			return
 		case e := <-s.eventCh.Out():
-			select {
-			case s.EventSink <- e.(Event):
-			case <-s.HaltCh():
-				s.log.Debugf("Event sink worker terminating gracefully.")
-				return
-			}
+			s.publish(e.(Event))
 		}
 	}
 }
 
 func (s *Session) garbageCollectionWorker() {
-	timer := time.NewTimer(cConstants.GarbageCollectionInterval)
+	timer := s.clock.NewTimer(cConstants.GarbageCollectionInterval)
 	defer timer.Stop()
 	for {
 		select {
 		case <-s.HaltCh():
 			s.log.Debugf("Garbage collection worker terminating gracefully.")
 			return
-		case <-timer.C:
+		case <-timer.C():
 			s.garbageCollect()
 			timer.Reset(cConstants.GarbageCollectionInterval)
 		}
@@ -175,14 +421,30 @@ func (s *Session) garbageCollectionWorker() {
 }
 
 func (s *Session) garbageCollect() {
+	// Nothing expires while paused, see Pause.
+	if s.isPaused() {
+		return
+	}
 	s.log.Debug("Running garbage collection process.")
 	// [sConstants.SURBIDLength]byte -> *Message
 	surbIDMapRange := func(rawSurbID, rawMessage interface{}) bool {
 		surbID := rawSurbID.([sConstants.SURBIDLength]byte)
 		message := rawMessage.(*Message)
-		if time.Now().After(message.SentAt.Add(message.ReplyETA).Add(cConstants.RoundTripTimeSlop)) {
+		// Late replies are given an extra RoundTripTimeSlop so that they
+		// still update the round trip time estimate.
+		timeout := s.replyTimeout(message) + cConstants.RoundTripTimeSlop
+		if s.clock.Now().After(message.SentAt.Add(timeout)) {
 			s.log.Debug("Garbage collecting SURB ID Map entry for Message ID %x", message.ID)
 			s.surbIDMap.Delete(surbID)
+			if message.IsDecoy {
+				s.decoyStats.lost(message.ID)
+			}
+			// Reliable messages are retransmitted instead, and the
+			// caller of a blocking send already timed out.
+			if !message.IsDecoy && !message.Reliable && !message.IsBlocking {
+				s.statuses.setState(message.ID, MessageGarbageCollected, nil)
+				s.completeBatchMessage(message.ID, MessageGarbageCollected, nil, nil)
+			}
 			s.eventCh.In() <- &MessageIDGarbageCollected{
 				MessageID: message.ID,
 			}
@@ -190,6 +452,10 @@ func (s *Session) garbageCollect() {
 		return true
 	}
 	s.surbIDMap.Range(surbIDMapRange)
+	s.reportLoopDecoyStats()
+	if n := s.replyReassembler.Prune(); n > 0 {
+		s.log.Debugf("Discarded %d partially received replies", n)
+	}
 }
 
 func (s *Session) awaitFirstPKIDoc(ctx context.Context) error {
@@ -201,17 +467,17 @@ func (s *Session) awaitFirstPKIDoc(ctx context.Context) error {
 		case <-s.HaltCh():
 			s.log.Debugf("Await first pki doc worker terminating gracefully")
 			return errors.New("terminating gracefully")
-		case <-time.After(time.Duration(s.cfg.Debug.InitialMaxPKIRetrievalDelay) * time.Second):
+		case <-s.clock.After(time.Duration(s.cfg.Debug.InitialMaxPKIRetrievalDelay) * time.Second):
 			return errors.New("timeout failure awaiting first PKI document")
 		case qo = <-s.opCh:
 		}
 		switch op := qo.(type) {
 		case opNewDocument:
-			// Determine if PKI doc is valid. If not then abort.
-			err := s.isDocValid(op.doc)
-			if err != nil {
-				s.fatalErrCh <- fmt.Errorf("aborting, PKI doc is not valid for our decoy traffic use case: %v", err)
-				return err
+			// The worker applies the policy to this document again,
+			// only abort if it is rejected.
+			action, err := s.checkDocument(op.doc)
+			if action == RejectDocument {
+				return fmt.Errorf("aborting, PKI doc rejected by the document policy: %v", err)
 			}
 			return nil
 		default:
@@ -224,7 +490,7 @@ func (s *Session) awaitFirstPKIDoc(ctx context.Context) error {
 // GetService returns a randomly selected service
 // matching the specified service name
 func (s *Session) GetService(serviceName string) (*utils.ServiceDescriptor, error) {
-	doc := s.minclient.CurrentDocument()
+	doc := s.CurrentDocument()
 	if doc == nil {
 		return nil, errors.New("pki doc is nil")
 	}
@@ -232,12 +498,14 @@ func (s *Session) GetService(serviceName string) (*utils.ServiceDescriptor, erro
 	if len(serviceDescriptors) == 0 {
 		return nil, errors.New("error, GetService failure, service not found in pki doc")
 	}
-	return &serviceDescriptors[mrand.Intn(len(serviceDescriptors))], nil
+	s.rngLock.Lock()
+	defer s.rngLock.Unlock()
+	return &serviceDescriptors[s.rng.Intn(len(serviceDescriptors))], nil
 }
 
 // OnConnection will be called by the minclient api
 // upon connection change status to the Provider
-func (s *Session) onConnection(err error) {
+func (s *Session) onConnection(generation uint64, err error) {
 	s.log.Debugf("onConnection %v", err)
 	s.eventCh.In() <- &ConnectionStatusEvent{
 		IsConnected: err == nil,
@@ -245,6 +513,8 @@ func (s *Session) onConnection(err error) {
 	}
 	s.opCh <- opConnStatusChanged{
 		isConnected: err == nil,
+		err:         err,
+		generation:  generation,
 	}
 }
 
@@ -252,17 +522,10 @@ func (s *Session) onConnection(err error) {
 // upon receiving a message
 func (s *Session) onMessage(ciphertextBlock []byte) error {
 	s.log.Debugf("OnMessage")
+	s.handleInbound(ciphertextBlock)
 	return nil
 }
 
-func (s *Session) incrementDecoyLoopTally() {
-	atomic.AddUint64(&s.decoyLoopTally, 1)
-}
-
-func (s *Session) decrementDecoyLoopTally() {
-	atomic.AddUint64(&s.decoyLoopTally, ^uint64(0))
-}
-
 // OnACK is called by the minclient api when we receive a SURB reply message.
 func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte) error {
 	idStr := fmt.Sprintf("[%v]", hex.EncodeToString(surbID[:]))
@@ -280,14 +543,20 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 		s.log.Infof("Discarding SURB Reply, decryption failure: %s", err)
 		return nil
 	}
+	s.rtts.observe(msg, s.clock.Now())
 	if len(plaintext) != coreConstants.ForwardPayloadLength {
 		s.log.Warningf("Discarding SURB %v: Invalid payload size: %v", idStr, len(plaintext))
 		return nil
 	}
 	if msg.WithSURB && msg.IsDecoy {
-		s.decrementDecoyLoopTally()
+		s.decoyStats.returned(msg.ID, s.clock.Now().Sub(msg.SentAt))
+		return nil
+	}
+	if msg.Reliable && !s.onARQReply(msg) {
+		s.log.Debugf("Discarding surb %v for reliable message %x: already delivered", idStr, msg.ID)
 		return nil
 	}
+	s.statuses.setState(msg.ID, MessageReplied, nil)
 
 	if msg.IsBlocking {
 		replyWaitChanRaw, ok := s.replyWaitChanMap.Load(*msg.ID)
@@ -298,22 +567,35 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 			return nil
 		}
 		replyWaitChan := replyWaitChanRaw.(chan []byte)
-		replyWaitChan <- plaintext[2:]
+		select {
+		case replyWaitChan <- plaintext[2:]:
+		default:
+			s.log.Warningf("Discarding duplicate surb %v for blocking message %x", idStr, msg.ID)
+		}
+	} else if fragment, ok := replyFragment(plaintext[2:]); ok {
+		s.onFragmentReply(fragment)
+		s.completeBatchMessage(msg.ID, MessageReplied, plaintext[2:], nil)
 	} else {
+		var replyErr error
+		if msg.ReplyCheck != nil {
+			replyErr = msg.ReplyCheck(plaintext[2:])
+		}
 		s.eventCh.In() <- &MessageReplyEvent{
 			MessageID: msg.ID,
 			Payload:   plaintext[2:],
-			Err:       nil,
+			Err:       replyErr,
 		}
+		s.completeBatchMessage(msg.ID, MessageReplied, plaintext[2:], replyErr)
 	}
 	return nil
 }
 
-func (s *Session) onDocument(doc *cpki.Document) {
+func (s *Session) onDocument(generation uint64, doc *cpki.Document) {
 	s.log.Debugf("onDocument(): Epoch %v", doc.Epoch)
 	s.hasPKIDoc = true
 	s.opCh <- opNewDocument{
-		doc: doc,
+		doc:        doc,
+		generation: generation,
 	}
 	s.eventCh.In() <- &NewDocumentEvent{
 		Document: doc,
@@ -321,7 +603,14 @@ func (s *Session) onDocument(doc *cpki.Document) {
 }
 
 func (s *Session) CurrentDocument() *cpki.Document {
-	return s.minclient.CurrentDocument()
+	s.minclientLock.RLock()
+	if s.paused {
+		defer s.minclientLock.RUnlock()
+		return s.lastDocument
+	}
+	client := s.minclient
+	s.minclientLock.RUnlock()
+	return client.CurrentDocument()
 }
 
 func (s *Session) GetReunionConfig() *config.Reunion {
@@ -334,6 +623,13 @@ func (s *Session) GetPandaConfig() *config.Panda {
 
 func (s *Session) Shutdown() {
 	s.Halt()
-	s.minclient.Shutdown()
-	s.minclient.Wait()
+	s.arqTimerQueue.Halt()
+	client := s.currentMinclient()
+	client.Shutdown()
+	client.Wait()
+	s.closeEgressQueue()
+	if s.ownedPKIClient != nil {
+		s.pkiClient.Shutdown()
+		s.ownedPKIClient.Shutdown()
+	}
 }
@@ -0,0 +1,65 @@
+package client
+
+import (
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	cConstants "github.com/katzenpost/client/constants"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGarbageCollectionWorker(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	s := newTestSession(clk, newTestMinclient(nil))
+	msg := newTestMessage(1)
+	msg.IsBlocking = false
+	s.statuses.queued(msg.ID)
+	msg.SentAt = clk.Now()
+	msg.ReplyETA = time.Minute
+	s.statuses.sent(msg, msg.ReplyETA, nil)
+	surbID := [sConstants.SURBIDLength]byte{1}
+	s.surbIDMap.Store(surbID, msg)
+	expiry := msg.SentAt.Add(s.replyTimeout(msg) + cConstants.RoundTripTimeSlop)
+
+	s.Go(s.garbageCollectionWorker)
+	defer s.Halt()
+	clk.BlockUntil(1)
+	for !clk.Now().Add(cConstants.GarbageCollectionInterval).After(expiry) {
+		clk.Advance(cConstants.GarbageCollectionInterval)
+		// wait for the collection to complete
+		clk.BlockUntil(1)
+		_, ok := s.surbIDMap.Load(surbID)
+		require.True(ok, "collected early at %v", clk.Now())
+	}
+	clk.Advance(cConstants.GarbageCollectionInterval)
+	clk.BlockUntil(1)
+	_, ok := s.surbIDMap.Load(surbID)
+	assert.False(ok)
+	status, err := s.MessageStatus(msg.ID)
+	require.NoError(err)
+	assert.Equal(MessageGarbageCollected, status.State)
+	e := (<-s.eventCh.Out()).(*MessageIDGarbageCollected)
+	assert.Equal(msg.ID, e.MessageID)
+}
+
+func TestSessionOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	newRand := func() *mrand.Rand {
+		return mrand.New(mrand.NewSource(1))
+	}
+	s := new(Session)
+	for _, opt := range []SessionOption{WithClock(clk), WithRand(newRand)} {
+		opt(s)
+	}
+	assert.Equal(clk, s.clock)
+	assert.Equal(newRand().Int63(), s.newRand().Int63())
+}
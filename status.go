@@ -0,0 +1,223 @@
+// status.go - Message lifecycle status.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+// messageStatusHistorySize is the number of messages whose status is
+// remembered, the oldest are forgotten first.
+const messageStatusHistorySize = 4096
+
+// ErrMessageStatusNotFound is the error issued when the status of a message
+// is unknown, either because it was never queued or because it was
+// forgotten.
+var ErrMessageStatusNotFound = errors.New("message status not found")
+
+// MessageState is the lifecycle state of a message.
+type MessageState int
+
+const (
+	// MessageQueued is the state of a message waiting in the egress queue.
+	MessageQueued MessageState = iota
+
+	// MessageSent is the state of a message handed to the Provider.
+	MessageSent
+
+	// MessageReplied is the state of a message whose reply was received.
+	MessageReplied
+
+	// MessageTimedOut is the state of a message whose reply did not
+	// arrive in time for a blocking caller.
+	MessageTimedOut
+
+	// MessageGarbageCollected is the state of a message whose SURB was
+	// garbage collected without a reply.
+	MessageGarbageCollected
+
+	// MessageFailed is the state of a message which could not be sent, or
+	// a reliable message which was given up on.
+	MessageFailed
+
+	// MessageCancelled is the state of a message removed from the egress
+	// queue before it was sent.
+	MessageCancelled
+)
+
+// String returns a string representation of a MessageState.
+func (s MessageState) String() string {
+	switch s {
+	case MessageQueued:
+		return "queued"
+	case MessageSent:
+		return "sent"
+	case MessageReplied:
+		return "replied"
+	case MessageTimedOut:
+		return "timed out"
+	case MessageGarbageCollected:
+		return "garbage collected"
+	case MessageFailed:
+		return "failed"
+	case MessageCancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// MessageStatus is the lifecycle status of a message.
+type MessageStatus struct {
+	// MessageID is the local unique identifier for the message.
+	MessageID *[cConstants.MessageIDLength]byte
+
+	// State is the current state of the message.
+	State MessageState
+
+	// QueuedAt is the time the message was first queued.
+	QueuedAt time.Time
+
+	// SentAt is the time the message was last sent.
+	SentAt time.Time
+
+	// ReplyETA is the expected round trip time to receive a response.
+	ReplyETA time.Duration
+
+	// RepliedAt is the time the reply was received.
+	RepliedAt time.Time
+
+	// Attempts is the number of times the message was sent.
+	Attempts int
+
+	// Err is the error which made the message fail, if any.
+	Err error
+}
+
+// statusHistory is a bounded history of message statuses.
+type statusHistory struct {
+	sync.Mutex
+	clock    clock.Clock
+	statuses map[[cConstants.MessageIDLength]byte]*MessageStatus
+	order    [][cConstants.MessageIDLength]byte
+}
+
+func newStatusHistory(clk clock.Clock) *statusHistory {
+	return &statusHistory{
+		clock:    clk,
+		statuses: make(map[[cConstants.MessageIDLength]byte]*MessageStatus),
+	}
+}
+
+func (h *statusHistory) get(id *[cConstants.MessageIDLength]byte) (*MessageStatus, bool) {
+	h.Lock()
+	defer h.Unlock()
+	status, ok := h.statuses[*id]
+	if !ok {
+		return nil, false
+	}
+	copied := *status
+	return &copied, true
+}
+
+// update applies fn to the status of the message if it is known.
+func (h *statusHistory) update(id *[cConstants.MessageIDLength]byte, fn func(*MessageStatus)) {
+	h.Lock()
+	defer h.Unlock()
+	if status, ok := h.statuses[*id]; ok {
+		fn(status)
+	}
+}
+
+func (h *statusHistory) queued(id *[cConstants.MessageIDLength]byte) {
+	h.Lock()
+	defer h.Unlock()
+	if status, ok := h.statuses[*id]; ok {
+		// A retransmission.
+		status.State = MessageQueued
+		return
+	}
+	if len(h.order) >= messageStatusHistorySize {
+		delete(h.statuses, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.statuses[*id] = &MessageStatus{
+		MessageID: id,
+		State:     MessageQueued,
+		QueuedAt:  h.clock.Now(),
+	}
+	h.order = append(h.order, *id)
+}
+
+func (h *statusHistory) remove(id *[cConstants.MessageIDLength]byte) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.statuses[*id]; !ok {
+		return
+	}
+	delete(h.statuses, *id)
+	for i, other := range h.order {
+		if other == *id {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *statusHistory) sent(msg *Message, replyETA time.Duration, err error) {
+	h.update(msg.ID, func(status *MessageStatus) {
+		if err != nil {
+			// Reliable messages are retransmitted.
+			if !msg.Reliable {
+				status.State = MessageFailed
+				status.Err = err
+			}
+			return
+		}
+		status.State = MessageSent
+		status.SentAt = msg.SentAt
+		status.ReplyETA = replyETA
+		status.Attempts++
+	})
+}
+
+func (h *statusHistory) setState(id *[cConstants.MessageIDLength]byte, state MessageState, err error) {
+	h.update(id, func(status *MessageStatus) {
+		if status.State == MessageReplied {
+			return
+		}
+		status.State = state
+		status.Err = err
+		if state == MessageReplied {
+			status.RepliedAt = h.clock.Now()
+		}
+	})
+}
+
+// MessageStatus returns the current status of a message queued by this
+// session.  The status of older messages is eventually forgotten.
+func (s *Session) MessageStatus(id *[cConstants.MessageIDLength]byte) (*MessageStatus, error) {
+	status, ok := s.statuses.get(id)
+	if !ok {
+		return nil, ErrMessageStatusNotFound
+	}
+	return status, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusHistory(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	h := newStatusHistory(clock.Real)
+	msg := &Message{ID: &[cConstants.MessageIDLength]byte{1}}
+	_, ok := h.get(msg.ID)
+	assert.False(ok)
+
+	h.queued(msg.ID)
+	status, ok := h.get(msg.ID)
+	require.True(ok)
+	assert.Equal(MessageQueued, status.State)
+
+	msg.SentAt = time.Now()
+	h.sent(msg, time.Second, nil)
+	status, ok = h.get(msg.ID)
+	require.True(ok)
+	assert.Equal(MessageSent, status.State)
+	assert.Equal(msg.SentAt, status.SentAt)
+	assert.Equal(time.Second, status.ReplyETA)
+	assert.Equal(1, status.Attempts)
+
+	h.setState(msg.ID, MessageReplied, nil)
+	// a late garbage collection does not override the reply
+	h.setState(msg.ID, MessageGarbageCollected, nil)
+	status, ok = h.get(msg.ID)
+	require.True(ok)
+	assert.Equal(MessageReplied, status.State)
+	assert.False(status.RepliedAt.IsZero())
+
+	failed := &Message{ID: &[cConstants.MessageIDLength]byte{2}}
+	h.queued(failed.ID)
+	h.sent(failed, 0, errors.New("not connected"))
+	status, ok = h.get(failed.ID)
+	require.True(ok)
+	assert.Equal(MessageFailed, status.State)
+	assert.Error(status.Err)
+
+	// the history is bounded
+	for i := 0; i < messageStatusHistorySize; i++ {
+		id := new([cConstants.MessageIDLength]byte)
+		binary.BigEndian.PutUint32(id[4:], uint32(i))
+		h.queued(id)
+	}
+	_, ok = h.get(msg.ID)
+	assert.False(ok)
+	assert.Equal(messageStatusHistorySize, len(h.statuses))
+}
@@ -21,6 +21,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashcloak/Meson-client/clock"
 	"github.com/katzenpost/core/queue"
 	"github.com/katzenpost/core/worker"
 )
@@ -41,6 +42,7 @@ type TimerQueue struct {
 
 	priq  *queue.PriorityQueue
 	nextQ nqueue
+	clock clock.Clock
 
 	timer  *time.Timer
 	wakech chan struct{}
@@ -48,8 +50,15 @@ type TimerQueue struct {
 
 // NewTimerQueue intantiates a new TimerQueue and starts the worker routine
 func NewTimerQueue(nextQueue nqueue) *TimerQueue {
+	return NewTimerQueueWithClock(nextQueue, clock.Real)
+}
+
+// NewTimerQueueWithClock is like NewTimerQueue but the item deadlines are
+// relative to the given clock.
+func NewTimerQueueWithClock(nextQueue nqueue, clk clock.Clock) *TimerQueue {
 	a := &TimerQueue{
 		nextQ: nextQueue,
+		clock: clk,
 		timer: time.NewTimer(0),
 		priq:  queue.New(),
 	}
@@ -129,16 +138,19 @@ func (a *TimerQueue) forward() {
 func (a *TimerQueue) worker() {
 	for {
 		var c <-chan time.Time
+		var timer clock.Timer
 		a.Lock()
 		if m := a.priq.Peek(); m != nil {
 			// Figure out if the message needs to be handled now.
-			timeLeft := int64(m.Priority) - time.Now().UnixNano()
-			if timeLeft < 0 || m.Priority < uint64(time.Now().UnixNano()) {
+			now := a.clock.Now().UnixNano()
+			timeLeft := int64(m.Priority) - now
+			if timeLeft < 0 || m.Priority < uint64(now) {
 				a.Unlock()
 				a.forward()
 				continue
 			} else {
-				c = time.After(time.Duration(timeLeft))
+				timer = a.clock.NewTimer(time.Duration(timeLeft))
+				c = timer.C()
 			}
 		}
 		a.Unlock()
@@ -149,5 +161,8 @@ func (a *TimerQueue) worker() {
 			a.forward()
 		case <-a.wakeupCh():
 		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 }
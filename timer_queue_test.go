@@ -21,6 +21,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashcloak/Meson-client/clock"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/stretchr/testify/assert"
 )
@@ -117,3 +118,31 @@ func TestTimerQueueRemove(t *testing.T) {
 	assert.Equal(5, j)
 	a.Halt()
 }
+
+type chanQueue chan Item
+
+func (q chanQueue) Push(i Item) error {
+	q <- i
+	return nil
+}
+
+func TestTimerQueueClock(t *testing.T) {
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	q := make(chanQueue, 1)
+	a := NewTimerQueueWithClock(q, clk)
+	defer a.Halt()
+
+	m := &Message{QueuePriority: uint64(clk.Now().Add(time.Minute).UnixNano())}
+	a.Push(m)
+	// The worker misses the wakeup if it is not waiting yet.
+	for clk.Timers() == 0 {
+		a.Signal()
+		<-time.After(time.Millisecond)
+	}
+	clk.Advance(59 * time.Second)
+	assert.Equal(1, clk.Timers())
+	clk.Advance(time.Second)
+	assert.True(m == <-q)
+}
@@ -0,0 +1,149 @@
+// transaction.go - Cryptocurrency transaction submission.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashcloak/Meson-client/rpc"
+)
+
+// currencyRequestVersion is the version of the currency plugin requests.
+const currencyRequestVersion = 0
+
+// ErrNotStarted is the error issued when the Client has no session yet.
+var ErrNotStarted = errors.New("client is not started")
+
+// ErrUnsupportedChain is the error issued when no transaction encoder is
+// known for a chain.
+var ErrUnsupportedChain = errors.New("unsupported chain")
+
+// ErrChainMismatch is the error issued when submitting a transaction of a
+// chain other than the one the Client was created for.
+var ErrChainMismatch = errors.New("chain does not match the service of the client")
+
+// TxEncoder encodes a signed raw transaction the way the currency plugin of
+// a chain expects it.
+type TxEncoder func(rawTx []byte) string
+
+// EncodeEthereumTx encodes an Ethereum style transaction as 0x prefixed hex.
+func EncodeEthereumTx(rawTx []byte) string {
+	return "0x" + hex.EncodeToString(rawTx)
+}
+
+// EncodeCosmosTx encodes a Cosmos/Tendermint transaction as base64.
+func EncodeCosmosTx(rawTx []byte) string {
+	return base64.StdEncoding.EncodeToString(rawTx)
+}
+
+// EncodeBitcoinTx encodes a Bitcoin style transaction as raw hex.
+func EncodeBitcoinTx(rawTx []byte) string {
+	return hex.EncodeToString(rawTx)
+}
+
+// txEncoders maps the chain tickers to their transaction encoder.
+var txEncoders = map[string]TxEncoder{
+	// Ethereum and its testnets
+	"eth": EncodeEthereumTx,
+	"etc": EncodeEthereumTx,
+	"gor": EncodeEthereumTx,
+	"rin": EncodeEthereumTx,
+	"kov": EncodeEthereumTx,
+	"rop": EncodeEthereumTx,
+
+	// Cosmos/Tendermint chains
+	"cosmos": EncodeCosmosTx,
+	"atom":   EncodeCosmosTx,
+	"bnb":    EncodeCosmosTx,
+	"tbnb":   EncodeCosmosTx,
+
+	// Bitcoin style chains
+	"btc":  EncodeBitcoinTx,
+	"tbtc": EncodeBitcoinTx,
+	"ltc":  EncodeBitcoinTx,
+	"bch":  EncodeBitcoinTx,
+}
+
+// TxEncoderForChain returns the transaction encoder of the chain.
+func TxEncoderForChain(chain string) (TxEncoder, error) {
+	encoder, ok := txEncoders[strings.ToLower(chain)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedChain, chain)
+	}
+	return encoder, nil
+}
+
+// currencyRequest is the request of the Meson currency plugins.
+type currencyRequest struct {
+	Version int
+	Tx      string
+	Ticker  string
+}
+
+func newCurrencyRequest(chain string, rawTx []byte) (*currencyRequest, error) {
+	encoder, err := TxEncoderForChain(chain)
+	if err != nil {
+		return nil, err
+	}
+	return &currencyRequest{
+		Version: currencyRequestVersion,
+		Tx:      encoder(rawTx),
+		Ticker:  strings.ToUpper(chain),
+	}, nil
+}
+
+// serviceForChain returns the currency plugin service of the chain, which
+// is named after it, and checks that it is the service the Client was
+// created for, if any.
+func (c *Client) serviceForChain(chain string) (string, error) {
+	service := strings.ToLower(chain)
+	if c.service != "" && c.service != service {
+		return "", fmt.Errorf("%w: %v is not %v", ErrChainMismatch, chain, c.service)
+	}
+	return service, nil
+}
+
+// SendRawTransaction submits a signed raw transaction to the currency
+// plugin of the chain and returns the transaction hash it reported.  The
+// plugin is the service named after the chain, ErrChainMismatch is returned
+// if the Client was created for the service of another chain.  A
+// *rpc.ServiceError is returned if the plugin rejected the transaction.
+func (c *Client) SendRawTransaction(ctx context.Context, chain string, rawTx []byte) (string, error) {
+	session := c.defaultSession()
+	if session == nil {
+		return "", ErrNotStarted
+	}
+	service, err := c.serviceForChain(chain)
+	if err != nil {
+		return "", err
+	}
+	request, err := newCurrencyRequest(chain, rawTx)
+	if err != nil {
+		return "", err
+	}
+	response := new(rpc.Response)
+	err = rpc.NewClient(session, rpc.JSON).Call(ctx, service, request, response)
+	if err != nil {
+		return "", err
+	}
+	return response.Message, nil
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxEncoders(t *testing.T) {
+	assert := assert.New(t)
+
+	rawTx := []byte{0xde, 0xad, 0xbe, 0xef}
+	assert.Equal("0xdeadbeef", EncodeEthereumTx(rawTx))
+	assert.Equal("3q2+7w==", EncodeCosmosTx(rawTx))
+	assert.Equal("deadbeef", EncodeBitcoinTx(rawTx))
+
+	_, err := TxEncoderForChain("doge")
+	assert.True(errors.Is(err, ErrUnsupportedChain))
+}
+
+func TestCurrencyRequest(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	request, err := newCurrencyRequest("GOR", []byte{0x01, 0x02})
+	require.NoError(err)
+	raw, err := json.Marshal(request)
+	require.NoError(err)
+	assert.JSONEq(`{"Version":0,"Tx":"0x0102","Ticker":"GOR"}`, string(raw))
+}
+
+func TestServiceForChain(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Client{service: "gor"}
+	service, err := c.serviceForChain("GOR")
+	assert.NoError(err)
+	assert.Equal("gor", service)
+	_, err = c.serviceForChain("eth")
+	assert.True(errors.Is(err, ErrChainMismatch))
+
+	c = new(Client)
+	service, err = c.serviceForChain("ETH")
+	assert.NoError(err)
+	assert.Equal("eth", service)
+	_, err = c.SendRawTransaction(context.Background(), "eth", []byte{0x01})
+	assert.Equal(ErrNotStarted, err)
+}
@@ -19,10 +19,10 @@ package client
 import (
 	"errors"
 	"math"
+	"sync/atomic"
 	"time"
 
-	"github.com/katzenpost/client/constants"
-	"github.com/katzenpost/core/crypto/rand"
+	"github.com/hashcloak/Meson-client/clock"
 	"github.com/katzenpost/core/pki"
 )
 
@@ -30,93 +30,64 @@ type workerOp interface{}
 
 type opConnStatusChanged struct {
 	isConnected bool
+	err         error
+	generation  uint64
 }
 
 type opNewDocument struct {
-	doc *pki.Document
+	doc        *pki.Document
+	generation uint64
 }
 
 func (s *Session) connStatusChange(op opConnStatusChanged) bool {
 	isConnected := op.isConnected
 	if isConnected {
-		s.onlineAt = time.Now()
-
-		skew := s.minclient.ClockSkew()
-		absSkew := skew
-		if absSkew < 0 {
-			absSkew = -absSkew
-		}
-		if absSkew > constants.TimeSkewWarnDelta {
-			// Should this do more than just warn?  Should this
-			// use skewed time?  I don't know.
-			s.log.Warningf("The observed time difference between the host and provider clocks is '%v'. Correct your system time.", skew)
-		} else {
-			s.log.Debugf("Clock skew vs provider: %v", skew)
-		}
+		s.onlineAt = s.clock.Now()
 	}
 	return isConnected
 }
 
 func (s *Session) worker() {
 	const maxDuration = math.MaxInt64
-	mRng := rand.NewMath()
 	// The PKI doc should be cached since we've
 	// already waited until we received it.
-	doc := s.minclient.CurrentDocument()
+	doc := s.currentMinclient().CurrentDocument()
 	if doc == nil {
-		s.fatalErrCh <- errors.New("aborting, PKI doc is nil")
+		s.fatal(errors.New("aborting, PKI doc is nil"))
 		return
 	}
-
-	// LambdaP timer setup
-	lambdaP := doc.LambdaP
-	lambdaPMsec := uint64(rand.Exp(mRng, lambdaP))
-	if lambdaPMsec > doc.LambdaPMaxDelay {
-		lambdaPMsec = doc.LambdaPMaxDelay
-	}
-	lambdaPInterval := time.Duration(lambdaPMsec) * time.Millisecond
-	lambdaPTimer := time.NewTimer(lambdaPInterval)
-	defer lambdaPTimer.Stop()
-
-	// LambdaL timer setup
-	lambdaL := doc.LambdaL
-	lambdaLMsec := uint64(rand.Exp(mRng, lambdaL))
-	if lambdaLMsec > doc.LambdaLMaxDelay {
-		lambdaLMsec = doc.LambdaLMaxDelay
-	}
-	lambdaLInterval := time.Duration(lambdaLMsec) * time.Millisecond
-	lambdaLTimer := time.NewTimer(lambdaLInterval)
-	defer lambdaLTimer.Stop()
-
-	// LambdaD timer setup
-	lambdaD := doc.LambdaD
-	lambdaDMsec := uint64(rand.Exp(mRng, lambdaD))
-	if lambdaDMsec > doc.LambdaDMaxDelay {
-		lambdaDMsec = doc.LambdaDMaxDelay
+	s.scheduler.SetDocument(doc)
+	docAction := s.applyDocumentPolicy(doc)
+
+	// One timer per kind of traffic, LambdaP, LambdaL and LambdaD.
+	var timers [numTrafficKinds]clock.Timer
+	for kind := range timers {
+		timers[kind] = s.clock.NewTimer(s.scheduler.Next(TrafficKind(kind)))
+		defer timers[kind].Stop()
 	}
-	lambdaDInterval := time.Duration(lambdaDMsec) * time.Millisecond
-	lambdaDTimer := time.NewTimer(lambdaDInterval)
-	defer lambdaDTimer.Stop()
 
 	defer s.log.Debug("session worker halted")
 
 	isConnected := false
+	isPaused := false
+	isSkewSafe := true
+	connGeneration := uint64(0)
 	mustResetAllTimers := false
+	failover := newFailoverState()
 	for {
-		var lambdaPFired bool
-		var lambdaLFired bool
-		var lambdaDFired bool
+		fired := TrafficKind(-1)
 		var qo workerOp
+		var pauseDone chan struct{}
 		select {
 		case <-s.HaltCh():
 			s.log.Debugf("Session worker terminating gracefully.")
 			return
-		case <-lambdaPTimer.C:
-			lambdaPFired = true
-		case <-lambdaLTimer.C:
-			lambdaLFired = true
-		case <-lambdaDTimer.C:
-			lambdaDFired = true
+		case <-timers[TrafficSend].C():
+			fired = TrafficSend
+		case <-timers[TrafficLoopDecoy].C():
+			fired = TrafficLoopDecoy
+		case <-timers[TrafficDropDecoy].C():
+			fired = TrafficDropDecoy
 		case qo = <-s.opCh:
 		}
 
@@ -125,92 +96,83 @@ func (s *Session) worker() {
 			case opConnStatusChanged:
 				newConnectedStatus := s.connStatusChange(op)
 				isConnected = newConnectedStatus
+				connGeneration = op.generation
+				if isConnected && connGeneration == atomic.LoadUint64(&s.clientGeneration) {
+					isSkewSafe = s.checkClockSkew()
+				}
 				mustResetAllTimers = true
+				s.onFailoverConnStatus(failover, op)
+			case opPause:
+				isPaused = op.paused
+				mustResetAllTimers = true
+				pauseDone = op.done
 			case opNewDocument:
-				err := s.isDocValid(op.doc)
-				if err != nil {
-					s.fatalErrCh <- err
-				}
-				doc = op.doc
-				lambdaP = doc.LambdaP
-				lambdaL = doc.LambdaL
-				lambdaD = doc.LambdaD
+				docAction = s.applyDocumentPolicy(op.doc)
+				s.onFailoverDocument(failover, op)
+				s.scheduler.SetDocument(op.doc)
 				mustResetAllTimers = true
 			default:
 				s.log.Warningf("BUG: Worker received nonsensical op: %T", op)
 			} // end of switch
-		} else {
-			if isConnected {
-				if lambdaPFired {
-					s.sendFromQueueOrDecoy()
-				} else if lambdaLFired && !s.cfg.Debug.DisableDecoyTraffic {
+		}
+		// A connection status reported by a replaced minclient
+		// instance does not apply to the current one.
+		if connGeneration != atomic.LoadUint64(&s.clientGeneration) {
+			isConnected = false
+		}
+		// Nothing is sent over the topology of a rejected document, nor
+		// with an unsafe clock skew.
+		isSending := isConnected && !isPaused && isSkewSafe && docAction != RejectDocument
+		decoys := !s.cfg.Debug.DisableDecoyTraffic && docAction == AcceptDocument
+		if qo == nil && isSending {
+			switch fired {
+			case TrafficSend:
+				s.sendFromQueueOrDecoy(decoys)
+			case TrafficLoopDecoy:
+				if decoys && s.spendBandwidth(true) {
 					s.sendLoopDecoy()
-				} else if lambdaDFired && !s.cfg.Debug.DisableDecoyTraffic {
+				}
+			case TrafficDropDecoy:
+				if decoys && s.spendBandwidth(true) {
 					s.sendDropDecoy()
 				}
 			}
 		}
-		if isConnected {
-			lambdaPMsec := uint64(rand.Exp(mRng, lambdaP))
-			if lambdaPMsec > doc.LambdaPMaxDelay {
-				lambdaPMsec = doc.LambdaPMaxDelay
-			}
-			lambdaPInterval = time.Duration(lambdaPMsec) * time.Millisecond
-			lambdaLMsec := uint64(rand.Exp(mRng, lambdaL))
-			if lambdaLMsec > doc.LambdaLMaxDelay {
-				lambdaLMsec = doc.LambdaLMaxDelay
-			}
-			lambdaLInterval = time.Duration(lambdaLMsec) * time.Millisecond
-			lambdaDMsec := uint64(rand.Exp(mRng, lambdaD))
-			if lambdaDMsec > doc.LambdaDMaxDelay {
-				lambdaDMsec = doc.LambdaDMaxDelay
+
+		interval := func(kind TrafficKind) time.Duration {
+			if !isSending {
+				return time.Duration(maxDuration)
 			}
-			lambdaDInterval = time.Duration(lambdaDMsec) * time.Millisecond
-		} else {
-			lambdaLInterval = time.Duration(maxDuration)
-			lambdaPInterval = time.Duration(maxDuration)
-			lambdaDInterval = time.Duration(maxDuration)
+			return s.scheduler.Next(kind)
 		}
-
 		if mustResetAllTimers {
-			lambdaPTimer.Reset(lambdaPInterval)
-			lambdaLTimer.Reset(lambdaLInterval)
-			lambdaDTimer.Reset(lambdaDInterval)
+			for kind := range timers {
+				timers[kind].Reset(interval(TrafficKind(kind)))
+			}
 			mustResetAllTimers = false
-		} else {
+		} else if fired >= 0 {
 			// reset only the timer that fired
-			if lambdaPFired {
-				lambdaPTimer.Reset(lambdaPInterval)
-			}
-			if lambdaLFired {
-				lambdaLTimer.Reset(lambdaLInterval)
-			}
-			if lambdaDFired {
-				lambdaDTimer.Reset(lambdaDInterval)
-			}
+			timers[fired].Reset(interval(fired))
+		}
+		// The pause takes effect once the timers are reset.
+		if pauseDone != nil {
+			close(pauseDone)
 		}
 	}
 
 	// NOTREACHED
 }
 
-func (s *Session) sendFromQueueOrDecoy() {
+func (s *Session) sendFromQueueOrDecoy(decoys bool) {
 	// Attempt to send user data first, if any exists.
 	// Otherwise send a drop decoy message.
+	// Queued messages are held while the bandwidth budget is exhausted.
 	_, err := s.egressQueue.Peek()
 	if err == nil {
-		s.sendNext()
-	} else if !s.cfg.Debug.DisableDecoyTraffic {
-		s.sendDropDecoy()
-	}
-}
-
-func (s *Session) isDocValid(doc *pki.Document) error {
-	for _, provider := range doc.Providers {
-		_, ok := provider.Kaetzchen[constants.LoopService]
-		if !ok {
-			return errors.New("found a Provider which does not have the loop service")
+		if s.spendBandwidth(false) {
+			s.sendNext()
 		}
+	} else if decoys && s.spendBandwidth(true) {
+		s.sendDropDecoy()
 	}
-	return nil
 }
@@ -0,0 +1,172 @@
+package client
+
+import (
+	mrand "math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson-client/clock"
+	"github.com/hashcloak/Meson-client/config"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/pki"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// testMinclient is a providerClient reporting the payloads sent on sent.
+type testMinclient struct {
+	doc  *pki.Document
+	sent chan []byte
+
+	haltOnce sync.Once
+	haltedCh chan struct{}
+}
+
+func newTestMinclient(doc *pki.Document) *testMinclient {
+	return &testMinclient{
+		doc:      doc,
+		sent:     make(chan []byte, 16),
+		haltedCh: make(chan struct{}),
+	}
+}
+
+func (c *testMinclient) CurrentDocument() *pki.Document {
+	return c.doc
+}
+
+func (c *testMinclient) ClockSkew() time.Duration {
+	return 0
+}
+
+func (c *testMinclient) SendCiphertext(recipient, provider string, surbID *[sConstants.SURBIDLength]byte, b []byte) ([]byte, time.Duration, error) {
+	c.sent <- b
+	return []byte("key"), time.Second, nil
+}
+
+func (c *testMinclient) SendUnreliableCiphertext(recipient, provider string, b []byte) error {
+	c.sent <- b
+	return nil
+}
+
+func (c *testMinclient) Shutdown() {
+	c.haltOnce.Do(func() { close(c.haltedCh) })
+}
+
+func (c *testMinclient) Wait() {
+	<-c.haltedCh
+}
+
+// testScheduler is a TrafficScheduler with a constant delay per kind of
+// traffic, which reports each call to Next on nextCh.
+type testScheduler struct {
+	delays [numTrafficKinds]time.Duration
+	nextCh chan TrafficKind
+	doc    *pki.Document
+}
+
+func newTestScheduler(send, loop, drop time.Duration) *testScheduler {
+	return &testScheduler{
+		delays: [numTrafficKinds]time.Duration{send, loop, drop},
+		nextCh: make(chan TrafficKind, 64),
+	}
+}
+
+func (t *testScheduler) SetDocument(doc *pki.Document) {
+	t.doc = doc
+}
+
+func (t *testScheduler) Next(kind TrafficKind) time.Duration {
+	t.nextCh <- kind
+	return t.delays[kind]
+}
+
+// awaitNext waits for the worker to schedule the given kinds of traffic.
+func (t *testScheduler) awaitNext(tt *testing.T, kinds ...TrafficKind) {
+	for _, kind := range kinds {
+		require.Equal(tt, kind, <-t.nextCh)
+	}
+}
+
+// newTestSession returns a session using clk and client, with a
+// deterministic source of randomness and without decoy traffic.
+func newTestSession(clk clock.Clock, client providerClient) *Session {
+	newRand := func() *mrand.Rand {
+		return mrand.New(mrand.NewSource(1))
+	}
+	return &Session{
+		cfg:              &config.Config{Debug: &config.Debug{DisableDecoyTraffic: true}},
+		log:              logging.MustGetLogger("test"),
+		eventCh:          channels.NewInfiniteChannel(),
+		opCh:             make(chan workerOp, 8),
+		clock:            clk,
+		newRand:          newRand,
+		rng:              newRand(),
+		minclient:        client,
+		egressQueue:      new(Queue),
+		docPolicy:        NewConfigDocumentPolicy(nil),
+		replyReassembler: NewReassemblerWithClock(DefaultReassemblyTimeout, clk),
+		statuses:         newStatusHistory(clk),
+		rtts:             newRTTTable(),
+		decoyStats:       newLoopDecoyStats(),
+	}
+}
+
+// assertNothingSent asserts that the worker sent nothing so far, which is
+// only reliable once the worker is known to be idle.
+func assertNothingSent(t *testing.T, client *testMinclient) {
+	select {
+	case b := <-client.sent:
+		t.Fatalf("unexpected send of %x", b[:1])
+	default:
+	}
+}
+
+func TestWorkerSchedule(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	client := newTestMinclient(newTestPolicyDocument(3, 1, 1, 1))
+	s := newTestSession(clk, client)
+	scheduler := newTestScheduler(100*time.Millisecond, time.Hour, time.Hour)
+	s.scheduler = scheduler
+	for _, b := range []byte{1, 2} {
+		msg := newTestMessage(b)
+		msg.IsBlocking = false
+		require.NoError(s.enqueue(msg))
+	}
+	s.Go(s.worker)
+	defer s.Halt()
+	scheduler.awaitNext(t, TrafficSend, TrafficLoopDecoy, TrafficDropDecoy)
+
+	// nothing is sent until connected
+	s.opCh <- opConnStatusChanged{isConnected: true}
+	scheduler.awaitNext(t, TrafficSend, TrafficLoopDecoy, TrafficDropDecoy)
+	assertNothingSent(t, client)
+
+	clk.Advance(99 * time.Millisecond)
+	assertNothingSent(t, client)
+	clk.Advance(time.Millisecond)
+	assert.Equal([]byte{1}, <-client.sent)
+	// the timer is rearmed after being sampled
+	scheduler.awaitNext(t, TrafficSend)
+	clk.BlockUntil(int(numTrafficKinds))
+
+	clk.Advance(100 * time.Millisecond)
+	assert.Equal([]byte{2}, <-client.sent)
+	scheduler.awaitNext(t, TrafficSend)
+	clk.BlockUntil(int(numTrafficKinds))
+	status, err := s.MessageStatus(&[cConstants.MessageIDLength]byte{2})
+	require.NoError(err)
+	assert.Equal(MessageSent, status.State)
+	assert.Equal(clk.Now(), status.SentAt)
+
+	// the queue is empty and decoys are disabled
+	clk.Advance(100 * time.Millisecond)
+	scheduler.awaitNext(t, TrafficSend)
+	assertNothingSent(t, client)
+}